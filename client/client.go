@@ -9,8 +9,7 @@ import(
     "strings"
 )
 
-func Connect(config *Config) {
-
+func dial() *net.TCPConn {
     tcpAddr := &net.TCPAddr{
         IP: net.ParseIP("127.0.0.1"),
         Port: 2042,
@@ -19,8 +18,12 @@ func Connect(config *Config) {
     conn, err := net.DialTCP("tcp", nil, tcpAddr)
     if err != nil {
         log.Fatal(err)
-        return
     }
+    return conn
+}
+
+func Connect(config *Config) {
+    conn := dial()
     defer conn.Close()
 
     br := bufio.NewReader(conn)
@@ -29,6 +32,22 @@ func Connect(config *Config) {
     startCommunication(br, bw)
 }
 
+// Send a single command to the server and print its reply,
+// for running commands from scripts
+func Run(config *Config, cmd string) {
+    conn := dial()
+    defer conn.Close()
+
+    br := bufio.NewReader(conn)
+    bw := bufio.NewWriter(conn)
+
+    // skip "connection established"
+    listener(br)
+    fmt.Fprintln(bw, cmd)
+    bw.Flush()
+    fmt.Print(listener(br))
+}
+
 func listener(br *bufio.Reader) string {
     resp := ""
     for {
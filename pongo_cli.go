@@ -5,7 +5,9 @@ import(
     "fmt"
     "log"
     "flag"
+    "strconv"
     "./client"
+    "path/filepath"
 )
 
 const version = "0.4.0"
@@ -17,6 +19,8 @@ var (
     verbose     = flag.Bool("verbose", false, "Use verbose logging")
     conffile    = flag.String("config","/etc/pongo/conf/pongo_cli.conf","Override config file")
     cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
+    warm        = flag.String("warm", "", "Warm the cache with the URLs in a file or sitemap.xml and quit")
+    concurrency = flag.Int("concurrency", 8, "Number of URLs to warm at once")
 )
 
 func init() {
@@ -36,6 +40,17 @@ func main() {
         return
     }
 
+    if *warm != "" {
+        // the server reads the file, relative paths are ours
+        path, err := filepath.Abs(*warm)
+        if err != nil {
+            log.Println(err)
+            return
+        }
+        client.Run(config, "warm -c " + strconv.Itoa(*concurrency) + " " + path)
+        return
+    }
+
     client.Connect(config)
 
     fmt.Println("Goodbye.")
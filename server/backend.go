@@ -0,0 +1,103 @@
+package server
+
+import (
+    "time"
+    "errors"
+)
+
+// Storage used by the proxy for cached responses. Get reports
+// one of MISS, HIT or EXPIRED as its status, which ends up in
+// the $cache_status access log variable, and a nil Entry on MISS.
+// Purges with soft set mark entries expired instead of removing
+// them, so they can still be revalidated or served stale. Peek,
+// Keys and SetExpires are for inspecting the cache, Peek doesn't
+// count as a use of the entry and reports how often Get found it.
+type CacheBackend interface {
+    Get(key string) (e *Entry, status string)
+    Set(key string, e *Entry)
+    Delete(key string) bool
+    PurgePrefix(prefix string) int
+    PurgeTags(tags []string, soft bool) int
+    PurgeMatch(match func(key string, e *Entry) bool, soft bool) int
+    Peek(key string) (e *Entry, hits int64)
+    Keys(match func(key string) bool, limit int) []string
+    SetExpires(key string, t time.Time) bool
+    Stats() CacheStats
+}
+
+// A cached response and how long it may be served. Once expired,
+// an entry is kept for the longer of its two stale windows so it
+// can still be used while revalidating or when the origin fails.
+// Tags come from the origin's Surrogate-Key or Cache-Tag headers.
+// Host and URL are what it was requested as, without the port
+// and as the path and query respectively.
+type Entry struct {
+    Response                []byte
+    Expires                 time.Time
+    StaleWhileRevalidate    time.Duration
+    StaleIfError            time.Duration
+    Tags                    []string
+    Host                    string
+    URL                     string
+}
+
+// entry that is fresh for the given number of seconds
+func NewEntry(data []byte, seconds int) *Entry {
+    return &Entry{
+        Response:   data,
+        Expires:    time.Now().Add(time.Duration(seconds) * time.Second),
+    }
+}
+
+func (e *Entry) expired() bool {
+    return e.Expires.Before(time.Now())
+}
+
+// copy of the entry expiring at t, the entry itself may be in use
+func (e *Entry) withExpires(t time.Time) *Entry {
+    ne := *e
+    ne.Expires = t
+    return &ne
+}
+
+// whether the entry expired less than d ago
+func (e *Entry) staleWithin(d time.Duration) bool {
+    return time.Now().Before(e.Expires.Add(d))
+}
+
+// when the entry is of no more use and can be removed
+func (e *Entry) staleUntil() time.Time {
+    if e.StaleWhileRevalidate > e.StaleIfError {
+        return e.Expires.Add(e.StaleWhileRevalidate)
+    }
+    return e.Expires.Add(e.StaleIfError)
+}
+
+// creates a backend from the global cache config
+type CacheBackendFunc func(cfg CacheConfig) (CacheBackend, error)
+
+// backend used when cache.type is not set
+const defaultCacheType = "mem"
+
+var cacheBackends = make(map[string]CacheBackendFunc)
+
+// the backend shared by every vhost
+var cache CacheBackend
+
+// Make a backend available under name for use as cache.type.
+// Backends register themselves from init() in their own file.
+func RegisterCacheBackend(name string, f CacheBackendFunc) {
+    cacheBackends[name] = f
+}
+
+// Create the backend selected by cfg.Type
+func NewCacheBackend(cfg CacheConfig) (CacheBackend, error) {
+    if cfg.Type == "" {
+        cfg.Type = defaultCacheType
+    }
+    f, ok := cacheBackends[cfg.Type]
+    if !ok {
+        return nil, errors.New("Unknown cache type " + cfg.Type)
+    }
+    return f(cfg)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+    "io"
+    "log"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "net/http"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuit breaker defaults, times in seconds except the latency
+const (
+    defaultBreakerWindow        = 10
+    defaultBreakerMinRequests   = 20
+    defaultBreakerErrorRate     = 0.5
+    defaultBreakerSlowRate      = 0.5
+    defaultBreakerOpenTime      = 30
+    defaultBreakerTrials        = 1
+    defaultBreakerErrorStatus   = http.StatusServiceUnavailable
+)
+
+// states of a circuit breaker
+const (
+    breakerClosed   = "closed"
+    breakerOpen     = "open"
+    breakerHalfOpen = "half-open"
+)
+
+// Circuit breaker for each origin of a location. Once MinRequests
+// have been sent to an origin in a window of Window seconds, it trips
+// when ErrorRate of them failed or SlowRate of them took longer than
+// LatencyThreshold milliseconds to answer. It then stays open for
+// OpenTime seconds before letting HalfOpenRequests through to find out
+// whether the origin is back. While no origin can be tried, requests
+// are answered from stale cache or with ErrorStatus and ErrorBody.
+type BreakerConfig struct {
+    Window              int         `json:"window"`
+    MinRequests         int         `json:"min_requests"`
+    ErrorRate           float64     `json:"error_rate"`
+    LatencyThreshold    int         `json:"latency_threshold"`
+    SlowRate            float64     `json:"slow_rate"`
+    OpenTime            int         `json:"open_time"`
+    HalfOpenRequests    int         `json:"half_open_requests"`
+    ErrorStatus         int         `json:"error_status"`
+    ErrorBody           string      `json:"error_body"`
+}
+
+// check the config and fill in defaults
+func (bc *BreakerConfig) validate() error {
+    if bc.Window <= 0 {
+        bc.Window = defaultBreakerWindow
+    }
+    if bc.MinRequests <= 0 {
+        bc.MinRequests = defaultBreakerMinRequests
+    }
+    if bc.ErrorRate <= 0 {
+        bc.ErrorRate = defaultBreakerErrorRate
+    }
+    if bc.SlowRate <= 0 {
+        bc.SlowRate = defaultBreakerSlowRate
+    }
+    if bc.ErrorRate > 1 || bc.SlowRate > 1 {
+        return errors.New("circuit breaker rates must be at most 1")
+    }
+    if bc.OpenTime <= 0 {
+        bc.OpenTime = defaultBreakerOpenTime
+    }
+    if bc.HalfOpenRequests <= 0 {
+        bc.HalfOpenRequests = defaultBreakerTrials
+    }
+    if bc.ErrorStatus == 0 {
+        bc.ErrorStatus = defaultBreakerErrorStatus
+    }
+    if bc.ErrorStatus < 100 || bc.ErrorStatus > 599 {
+        return errors.New("invalid circuit breaker error status " + strconv.Itoa(bc.ErrorStatus))
+    }
+    return nil
+}
+
+// The breaker of an origin. A nil breaker is always closed,
+// for locations without one.
+type circuitBreaker struct {
+    lock        sync.Mutex
+    config      *BreakerConfig
+    name        string
+    state       string
+    start       time.Time   // of the window
+    requests    int
+    failures    int
+    slow        int
+    openUntil   time.Time
+    trials      int         // half-open requests let through
+    passed      int         // half-open requests that succeeded
+}
+
+func newCircuitBreaker(bc *BreakerConfig, name string) *circuitBreaker {
+    if bc == nil {
+        return nil
+    }
+    return &circuitBreaker{config: bc, name: name, state: breakerClosed, start: time.Now()}
+}
+
+// the breaker's state, for origins status
+func (b *circuitBreaker) status() string {
+    if b == nil {
+        return breakerClosed
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    return b.state
+}
+
+// whether the breaker is open and not due to let a trial through,
+// so the origin is passed over when picking one
+func (b *circuitBreaker) blocking() bool {
+    if b == nil {
+        return false
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    switch b.state {
+    case breakerOpen:
+        return time.Now().Before(b.openUntil)
+    case breakerHalfOpen:
+        return b.trials >= b.config.HalfOpenRequests
+    }
+    return false
+}
+
+// whether a request may be sent, counting it as a trial if half-open
+func (b *circuitBreaker) allow() bool {
+    if b == nil {
+        return true
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if b.state == breakerOpen {
+        if time.Now().Before(b.openUntil) {
+            return false
+        }
+        b.setState(breakerHalfOpen, "trying the origin again")
+    }
+    if b.state == breakerHalfOpen {
+        if b.trials >= b.config.HalfOpenRequests {
+            return false
+        }
+        b.trials++
+    }
+    return true
+}
+
+// count the outcome of a request allow let through
+func (b *circuitBreaker) record(failed bool, latency time.Duration) {
+    if b == nil {
+        return
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    slow := b.config.LatencyThreshold > 0 &&
+        latency > time.Duration(b.config.LatencyThreshold) * time.Millisecond
+
+    switch b.state {
+    case breakerHalfOpen:
+        if failed || slow {
+            b.trip("a trial request failed")
+            return
+        }
+        b.passed++
+        if b.passed >= b.config.HalfOpenRequests {
+            b.setState(breakerClosed, "trial requests succeeded")
+        }
+        return
+    case breakerOpen:
+        // sent before the breaker tripped
+        return
+    }
+
+    if time.Since(b.start) >= time.Duration(b.config.Window) * time.Second {
+        b.reset()
+    }
+    b.requests++
+    if failed {
+        b.failures++
+    }
+    if slow {
+        b.slow++
+    }
+    if b.requests < b.config.MinRequests {
+        return
+    }
+    if rate := float64(b.failures) / float64(b.requests); rate >= b.config.ErrorRate {
+        b.trip("error rate " + strconv.Itoa(int(rate * 100)) + "% of " + strconv.Itoa(b.requests) + " requests")
+    } else if rate := float64(b.slow) / float64(b.requests); b.slow > 0 && rate >= b.config.SlowRate {
+        b.trip("slow rate " + strconv.Itoa(int(rate * 100)) + "% of " + strconv.Itoa(b.requests) + " requests")
+    }
+}
+
+// forget a request allow let through that the client gave up on,
+// so a half-open breaker can let another trial through
+func (b *circuitBreaker) cancel() {
+    if b == nil {
+        return
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if b.state == breakerHalfOpen && b.trials > b.passed {
+        b.trials--
+    }
+}
+
+// close the breaker, as when the origin is enabled by hand
+func (b *circuitBreaker) close(reason string) {
+    if b == nil {
+        return
+    }
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    if b.state != breakerClosed {
+        b.setState(breakerClosed, reason)
+    }
+}
+
+// open the breaker for the open time, under the lock
+func (b *circuitBreaker) trip(reason string) {
+    b.openUntil = time.Now().Add(time.Duration(b.config.OpenTime) * time.Second)
+    b.setState(breakerOpen, reason)
+}
+
+// move to a new state with fresh counts, under the lock
+func (b *circuitBreaker) setState(state, reason string) {
+    log.Println("Circuit breaker for", b.name, "is " + state + ":", reason)
+    b.state = state
+    b.trials, b.passed = 0, 0
+    b.reset()
+}
+
+func (b *circuitBreaker) reset() {
+    b.start = time.Now()
+    b.requests, b.failures, b.slow = 0, 0, 0
+}
+
+// Answer a request that no origin could be tried for since their
+// breakers are open, with the configured error response
+func (lc *LocationConfig) serveCircuitOpen(rw http.ResponseWriter) int {
+    bc := lc.CircuitBreaker
+    rw.Header().Set("Retry-After", strconv.Itoa(bc.OpenTime))
+    if bc.ErrorBody != "" {
+        rw.Header().Set("Content-Type", http.DetectContentType([]byte(bc.ErrorBody)))
+        rw.Header().Set("Content-Length", strconv.Itoa(len(bc.ErrorBody)))
+    }
+    rw.WriteHeader(bc.ErrorStatus)
+    io.WriteString(rw, bc.ErrorBody)
+    return bc.ErrorStatus
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"time"
+	"context"
+	"net/http"
+	"sync/atomic"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Circuit breaker", func() {
+
+	var (
+		origin  *httptest.Server
+		status  int32
+		hits    int32
+		blocked int32
+		release chan bool
+		pool    *OriginPool
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&status, http.StatusOK)
+		atomic.StoreInt32(&hits, 0)
+		atomic.StoreInt32(&blocked, 0)
+		release = make(chan bool)
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			if atomic.LoadInt32(&blocked) == 1 {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		var err error
+		pool, err = newOriginPool(&LocationConfig{
+			Origin: origin.URL,
+			CircuitBreaker: &BreakerConfig{
+				Window: 60,
+				MinRequests: 4,
+				ErrorRate: 0.5,
+				OpenTime: 1,
+				HalfOpenRequests: 1,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	// a request to the origin, with the status it got or
+	// zero if the breaker didn't let it through
+	request := func() int {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := roundTrip(pool.transport, pool, pool.Origins[0], req)
+		if err != nil {
+			Expect(err).To(MatchError("circuit breaker is open"))
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("goes from closed to open to half-open and back to closed", func() {
+		for _, step := range []struct {
+			name    string
+			wait    time.Duration
+			origin  int
+			want    []int
+		}{
+			{"closed", 0, 200, []int{200, 200}},
+			{"closed, failing", 0, 503, []int{503, 503}},
+			{"open", 0, 503, []int{0, 0, 0}},
+			{"half-open, trial fails", 1100 * time.Millisecond, 503, []int{503}},
+			{"open again", 0, 200, []int{0, 0}},
+			{"half-open, trial passes", 1100 * time.Millisecond, 200, []int{200}},
+			{"closed again", 0, 503, []int{503, 503, 503}},
+			{"open after failing again", 0, 200, []int{200, 0}},
+		} {
+			time.Sleep(step.wait)
+			atomic.StoreInt32(&status, int32(step.origin))
+			for _, want := range step.want {
+				before := atomic.LoadInt32(&hits)
+				Expect(request()).To(Equal(want), step.name)
+				if want == 0 {
+					Expect(atomic.LoadInt32(&hits)).To(Equal(before), step.name)
+				}
+			}
+		}
+	})
+
+	It("lets only half_open_requests through while half-open", func() {
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		for i := 0; i < 4; i++ {
+			request()
+		}
+		Expect(request()).To(Equal(0))
+		time.Sleep(1100 * time.Millisecond)
+
+		atomic.StoreInt32(&status, http.StatusOK)
+		atomic.StoreInt32(&blocked, 1)
+		trial := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			trial <- request()
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&hits) }).Should(BeNumerically("==", 5))
+		Expect(request()).To(Equal(0))
+		close(release)
+		Expect(<-trial).To(Equal(200))
+		Expect(request()).To(Equal(200))
+	})
+
+	It("doesn't count requests the client gave up on", func() {
+		cancelled := func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+			defer cancel()
+			req, _ := http.NewRequest("GET", "/", nil)
+			_, err := roundTrip(pool.transport, pool, pool.Origins[0], req.WithContext(ctx))
+			Expect(err).To(HaveOccurred())
+		}
+
+		atomic.StoreInt32(&blocked, 1)
+		for i := 0; i < 4; i++ {
+			cancelled()
+		}
+		Expect(pool.Origins[0].breaker.status()).To(Equal(breakerClosed))
+
+		atomic.StoreInt32(&blocked, 0)
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		for i := 0; i < 4; i++ {
+			request()
+		}
+		Expect(request()).To(Equal(0))
+		time.Sleep(1100 * time.Millisecond)
+
+		// the cancelled trial hands its place to the next request
+		atomic.StoreInt32(&blocked, 1)
+		cancelled()
+		Expect(pool.Origins[0].breaker.status()).To(Equal(breakerHalfOpen))
+		atomic.StoreInt32(&blocked, 0)
+		atomic.StoreInt32(&status, http.StatusOK)
+		Expect(request()).To(Equal(200))
+		Expect(pool.Origins[0].breaker.status()).To(Equal(breakerClosed))
+	})
+
+	It("makes the pool pass over an origin whose breaker is open", func() {
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer other.Close()
+		p, err := newOriginPool(&LocationConfig{
+			Origins: []OriginConfig{{URL: origin.URL}, {URL: other.URL}},
+			// above the failures sent, so only the breaker takes it out
+			MaxFails: 10,
+			CircuitBreaker: &BreakerConfig{MinRequests: 4, OpenTime: 60},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		pool = p
+
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		for i := 0; i < 4; i++ {
+			Expect(request()).To(Equal(503))
+		}
+		Expect(p.Origins[0].state()).To(Equal(originUp))
+		Expect(p.Origins[0].breaker.status()).To(Equal(breakerOpen))
+		for i := 0; i < 10; i++ {
+			Expect(p.pick("", nil)).To(Equal(p.Origins[1]))
+		}
+	})
+})
@@ -1,26 +1,88 @@
 package server
 
 import (
-	"log"
-	"time"
+    "log"
+    "sync"
+    "time"
+    "runtime"
     "strings"
-	"net/http"
+    "net/http"
+    "sync/atomic"
+    "container/list"
 )
 
-// rudimentary cache item
-// replace in future with something more viable
+// used when the global config does not set cache.size
+const defaultCacheSize = 16 * 1024 * 1024
+
+// In-memory cache bounded by the number of bytes it holds.
+// Keys are spread over a power of two number of shards, each
+// with its own lock and LRU list, so that requests on different
+// keys rarely contend. When a new object doesn't fit, shards take
+// turns evicting their least recently used object until it does.
 type Cache struct {
-    Data        map[string]*cacheItem
-    MaxSize     int
+    MaxSize     int64
+    size        int64
+    stats       cacheCounters
+    shards      []*cacheShard
+    hand        uint32
+    mask        uint32
+    tags        *tagIndex
+    onEvict     func(key string, e *Entry)
+}
+
+type cacheShard struct {
+    lock        sync.Mutex
+    data        map[string]*list.Element
+    lru         *list.List
+    total       *int64
+    tags        *tagIndex
 }
 
 type cacheItem struct {
-    response    []byte
-    expireTime  time.Time
-    fetching    bool
+    key         string
+    entry       *Entry
+    hits        int64   // times Get found it, under the shard lock
+}
+
+// Counters describing the contents of the cache, how
+// lookups went and why objects have been removed from it
+type CacheStats struct {
+    Entries     int64
+    Bytes       int64
+    Hits        int64   // lookups finding a fresh object
+    Misses      int64   // lookups finding nothing or an expired object
+    Evictions   int64   // least recently used, removed to make room
+    Expired     int64   // removed by the cleaner after going stale
+    Rejected    int64   // larger than the whole cache, never stored
 }
 
-var cache *Cache
+// share of lookups that found a fresh object
+func (s CacheStats) HitRatio() float64 {
+    if s.Hits + s.Misses == 0 {
+        return 0
+    }
+    return float64(s.Hits) / float64(s.Hits + s.Misses)
+}
+
+// updated atomically from every shard
+type cacheCounters struct {
+    hits        int64
+    misses      int64
+    evictions   int64
+    expired     int64
+    rejected    int64
+}
+
+func init() {
+    RegisterCacheBackend("mem", func(cfg CacheConfig) (CacheBackend, error) {
+        return NewCache(cfg.Size), nil
+    })
+}
+
+// bytes accounted against MaxSize for a single item
+func (ci *cacheItem) size() int64 {
+    return int64(len(ci.key) + len(ci.entry.Response))
+}
 
 func (c *Cache) scheduleCleaner(d time.Duration) {
     t := time.Tick(d)
@@ -30,55 +92,267 @@ func (c *Cache) scheduleCleaner(d time.Duration) {
     }
 }
 
-func NewCache(size int) *Cache {
+// a few shards per CPU, rounded up to a power of two
+func shardCount() int {
+    n := 1
+    for n < runtime.GOMAXPROCS(0) * 4 {
+        n <<= 1
+    }
+    return n
+}
+
+func NewCache(size int64) *Cache {
+    if size <= 0 {
+        size = defaultCacheSize
+    }
+    n := shardCount()
     c := &Cache{
-        Data: make(map[string]*cacheItem),
         MaxSize: size,
+        shards: make([]*cacheShard, n),
+        mask: uint32(n - 1),
+        tags: newTagIndex(),
+    }
+    for i := range c.shards {
+        c.shards[i] = &cacheShard{
+            data: make(map[string]*list.Element),
+            lru: list.New(),
+            total: &c.size,
+            tags: c.tags,
+        }
     }
 
     go c.scheduleCleaner(60 * time.Second)
     return c
 }
 
-func (c *Cache) Get(key string) (data []byte, status string) {
-    empty := make([]byte, 0)
+// FNV-1a, inlined so looking up a shard doesn't allocate
+func (c *Cache) shard(key string) *cacheShard {
+    h := uint32(2166136261)
+    for i := 0; i < len(key); i++ {
+        h ^= uint32(key[i])
+        h *= 16777619
+    }
+    return c.shards[h & c.mask]
+}
+
+func (c *Cache) Get(key string) (*Entry, string) {
+    s := c.shard(key)
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    e, ok := s.data[key]
+    if !ok {
+        atomic.AddInt64(&c.stats.misses, 1)
+        return nil, "MISS"
+    }
+    s.lru.MoveToFront(e)
+    ci := e.Value.(*cacheItem)
+    ci.hits++
+    if ci.entry.expired() {
+        atomic.AddInt64(&c.stats.misses, 1)
+        return ci.entry, "EXPIRED"
+    }
+    atomic.AddInt64(&c.stats.hits, 1)
+    return ci.entry, "HIT"
+}
+
+func (c *Cache) Peek(key string) (*Entry, int64) {
+    s := c.shard(key)
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if e, ok := s.data[key]; ok {
+        ci := e.Value.(*cacheItem)
+        return ci.entry, ci.hits
+    }
+    return nil, 0
+}
+
+// keys match returns true for, at most limit of them if limit is set
+func (c *Cache) Keys(match func(key string) bool, limit int) []string {
+    keys := make([]string, 0)
+    for _, s := range c.shards {
+        s.lock.Lock()
+        for k := range s.data {
+            if limit > 0 && len(keys) >= limit {
+                break
+            }
+            if match(k) {
+                keys = append(keys, k)
+            }
+        }
+        s.lock.Unlock()
+    }
+    return keys
+}
+
+func (c *Cache) SetExpires(key string, t time.Time) bool {
+    s := c.shard(key)
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    e, ok := s.data[key]
+    if ok {
+        ci := e.Value.(*cacheItem)
+        ci.entry = ci.entry.withExpires(t)
+    }
+    return ok
+}
+
+// whether an entry is small enough for Set to store it
+func (c *Cache) fits(key string, entry *Entry) bool {
+    return (&cacheItem{key: key, entry: entry}).size() <= c.MaxSize
+}
+
+func (c *Cache) Set(key string, entry *Entry) {
+    ci := &cacheItem{
+        key:        key,
+        entry:      entry,
+    }
+    if !c.fits(key, entry) {
+        atomic.AddInt64(&c.stats.rejected, 1)
+        return
+    }
+
+    s := c.shard(key)
+    s.lock.Lock()
+    if e, ok := s.data[key]; ok {
+        s.remove(e)
+    }
+    s.data[key] = s.lru.PushFront(ci)
+    atomic.AddInt64(s.total, ci.size())
+    s.tags.add(key, entry.Tags)
+    s.lock.Unlock()
+
+    c.makeRoom(ci)
+}
 
-    if ci, ok := c.Data[key]; !ok {
-        return empty, "MISS"
-    } else if ci.expireTime.Before(time.Now()) {
-        return ci.response, "EXPIRED"
+// Evict until the cache is back within MaxSize. Only one shard
+// is locked at a time; the item just stored is never chosen.
+// Evicted items are handed to onEvict once the shard is unlocked.
+func (c *Cache) makeRoom(keep *cacheItem) {
+    misses := 0
+    for atomic.LoadInt64(&c.size) > c.MaxSize && misses < len(c.shards) {
+        var evicted *cacheItem
+        s := c.shards[atomic.AddUint32(&c.hand, 1) & c.mask]
+        s.lock.Lock()
+        if e := s.lru.Back(); e != nil && e.Value.(*cacheItem) != keep {
+            evicted = e.Value.(*cacheItem)
+            s.remove(e)
+            atomic.AddInt64(&c.stats.evictions, 1)
+            misses = 0
+        } else {
+            misses++
+        }
+        s.lock.Unlock()
+        if evicted != nil && c.onEvict != nil {
+            c.onEvict(evicted.key, evicted.entry)
+        }
+    }
+}
+
+// unlink an element from both the map and the LRU list,
+// must be called with the shard locked
+func (s *cacheShard) remove(e *list.Element) {
+    ci := e.Value.(*cacheItem)
+    s.lru.Remove(e)
+    delete(s.data, ci.key)
+    atomic.AddInt64(s.total, -ci.size())
+    s.tags.remove(ci.key, ci.entry.Tags)
+}
+
+// remove an element or, with soft, replace its entry with
+// an expired copy. Must be called with the shard locked.
+func (s *cacheShard) purge(e *list.Element, soft bool) {
+    if soft {
+        ci := e.Value.(*cacheItem)
+        if !ci.entry.expired() {
+            ci.entry = ci.entry.withExpires(time.Now())
+        }
     } else {
-        return ci.response, "HIT"
+        s.remove(e)
     }
 }
 
-func (c *Cache) Set(key string, data []byte, seconds int) {
-    c.Data[key] = &cacheItem{
-        response:   data,
-        expireTime: time.Now().Add(time.Duration(seconds) * time.Second),
+// remove a single key, reporting whether it was cached
+func (c *Cache) Delete(key string) bool {
+    s := c.shard(key)
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    e, ok := s.data[key]
+    if ok {
+        s.remove(e)
     }
-    if len(c.Data) > c.MaxSize {
-        go c.PurgeExpired()
+    return ok
+}
+
+// remove every key starting with prefix, returning how many were removed
+func (c *Cache) PurgePrefix(prefix string) int {
+    return c.PurgeMatch(func(key string, e *Entry) bool {
+        return strings.HasPrefix(key, prefix)
+    }, false)
+}
+
+// purge every entry with any of the tags, returning how many were purged
+func (c *Cache) PurgeTags(tags []string, soft bool) int {
+    n := 0
+    for _, key := range c.tags.lookup(tags) {
+        s := c.shard(key)
+        s.lock.Lock()
+        // the key may have been stored again since the lookup
+        if e, ok := s.data[key]; ok && e.Value.(*cacheItem).entry.hasTag(tags) {
+            s.purge(e, soft)
+            n++
+        }
+        s.lock.Unlock()
     }
+    return n
 }
 
-func (lc *LocationConfig) GetCacheKey(r *http.Request) string {
-    replacer := strings.NewReplacer(
-        "$scheme", r.URL.Scheme, 
-        "$host", r.Host, 
-        "$uri", r.URL.Path, 
-        "$querystring", r.URL.RawQuery,
-        "$method", r.Method,
-    )
-    return replacer.Replace(lc.CacheKey)
+// Purge every entry match returns true for, returning how many were
+// purged. match is called with the entry's shard locked.
+func (c *Cache) PurgeMatch(match func(key string, e *Entry) bool, soft bool) int {
+    n := 0
+    for _, s := range c.shards {
+        s.lock.Lock()
+        for k, e := range s.data {
+            if match(k, e.Value.(*cacheItem).entry) {
+                s.purge(e, soft)
+                n++
+            }
+        }
+        s.lock.Unlock()
+    }
+    return n
 }
 
+func (c *Cache) Stats() CacheStats {
+    st := CacheStats{
+        Bytes:      atomic.LoadInt64(&c.size),
+        Hits:       atomic.LoadInt64(&c.stats.hits),
+        Misses:     atomic.LoadInt64(&c.stats.misses),
+        Evictions:  atomic.LoadInt64(&c.stats.evictions),
+        Expired:    atomic.LoadInt64(&c.stats.expired),
+        Rejected:   atomic.LoadInt64(&c.stats.rejected),
+    }
+    for _, s := range c.shards {
+        s.lock.Lock()
+        st.Entries += int64(len(s.data))
+        s.lock.Unlock()
+    }
+    return st
+}
+
+// shards are cleaned one at a time so requests
+// are only ever blocked on a fraction of the cache
 func (c *Cache) PurgeExpired() {
     t := time.Now()
-    for k := range c.Data {
-        if c.Data[k].expireTime.Before(t) {
-            delete(c.Data, k)
+    for _, s := range c.shards {
+        s.lock.Lock()
+        for _, e := range s.data {
+            if e.Value.(*cacheItem).entry.staleUntil().Before(t) {
+                s.remove(e)
+                atomic.AddInt64(&c.stats.expired, 1)
+            }
         }
+        s.lock.Unlock()
     }
 }
 
@@ -89,16 +363,36 @@ func cacheableRequest(req *http.Request) bool {
         log.Println(req.Method)
         return false
     }
+    if parseCacheControl(req.Header).has("no-store") {
+        return false
+    }
 
     return true
 }
 
 // verify the response is cacheable in accordance with HTTP spec
 // and configurations for the vhost. TODO: add more requirements
-func cacheableResponse(resp *http.Response) bool {
+func cacheableResponse(req *http.Request, resp *http.Response) bool {
     if resp.StatusCode >= 400 {
         return false
     }
+    cc := parseCacheControl(resp.Header)
+    if cc.has("no-store") || cc.has("private") {
+        return false
+    }
+    if len(resp.Header["Set-Cookie"]) > 0 {
+        return false
+    }
+    for _, name := range varyHeaders(resp.Header) {
+        if name == "*" {
+            return false
+        }
+    }
+    // RFC 9111 section 3.5
+    if req.Header.Get("Authorization") != "" &&
+        !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+        return false
+    }
 
     return true
-}
\ No newline at end of file
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+    "time"
+    "strconv"
+    "strings"
+    "net/http"
+)
+
+// values for LocationConfig.ExpireMode
+const (
+    ExpireOrigin    = "origin"      // origin freshness wins, expire is the fallback
+    ExpireOverride  = "override"    // always cache for expire seconds
+)
+
+// Cache-Control directives keyed by their lower case name,
+// directives without an argument map to an empty string
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+    cc := make(cacheControl)
+    for _, v := range h["Cache-Control"] {
+        for _, d := range strings.Split(v, ",") {
+            name, arg := d, ""
+            if i := strings.Index(d, "="); i >= 0 {
+                name, arg = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), "\"")
+            }
+            if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+                cc[name] = arg
+            }
+        }
+    }
+    return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+    _, ok := cc[directive]
+    return ok
+}
+
+// delta-seconds argument of a directive, ok is false
+// when the directive is missing or malformed
+func (cc cacheControl) seconds(directive string) (int, bool) {
+    v, ok := cc[directive]
+    if !ok {
+        return 0, false
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 0 {
+        return 0, false
+    }
+    return n, true
+}
+
+// whether a cached copy may be used to answer the request,
+// clients can ask for the origin with no-cache or max-age=0
+func cacheLookupAllowed(req *http.Request) bool {
+    cc := parseCacheControl(req.Header)
+    if len(cc) == 0 {
+        return !strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")
+    }
+    if cc.has("no-cache") {
+        return false
+    }
+    if age, ok := cc.seconds("max-age"); ok && age == 0 {
+        return false
+    }
+    return true
+}
+
+// Freshness lifetime the origin gave the response, in seconds and
+// less any time already spent in other caches (RFC 9111 4.2.1).
+// ok is false when the origin didn't say.
+func originTTL(resp *http.Response) (ttl int, ok bool) {
+    cc := parseCacheControl(resp.Header)
+    age, err := strconv.Atoi(resp.Header.Get("Age"))
+    if err != nil || age < 0 {
+        age = 0
+    }
+
+    if ttl, ok = cc.seconds("s-maxage"); ok {
+        return ttl - age, true
+    }
+    if ttl, ok = cc.seconds("max-age"); ok {
+        return ttl - age, true
+    }
+    if v := resp.Header.Get("Expires"); v != "" {
+        expires, err := http.ParseTime(v)
+        if err != nil {
+            // invalid dates mean already expired
+            return 0, true
+        }
+        date, err := http.ParseTime(resp.Header.Get("Date"))
+        if err != nil {
+            date = time.Now()
+        }
+        return int(expires.Sub(date) / time.Second) - age, true
+    }
+    return 0, false
+}
+
+// Number of seconds to cache a response for at this location.
+// Responses marked no-cache are stored already stale, so that
+// every use of them is revalidated (RFC 9111 5.2.2.4).
+func (lc *LocationConfig) cacheTTL(resp *http.Response) int {
+    if lc.ExpireMode != ExpireOverride {
+        if parseCacheControl(resp.Header).has("no-cache") {
+            return 0
+        }
+        if ttl, ok := originTTL(resp); ok {
+            return ttl
+        }
+    }
+    return lc.Expire
+}
+
+// Stale windows for a response. The stale-while-revalidate and
+// stale-if-error extensions from RFC 5861 win over the location's
+// settings, and must-revalidate, proxy-revalidate or no-cache rule
+// out both.
+func (lc *LocationConfig) staleWindows(resp *http.Response) (swr, sie time.Duration) {
+    swr = time.Duration(lc.StaleWhileRevalidate) * time.Second
+    sie = time.Duration(lc.StaleIfError) * time.Second
+    if lc.ExpireMode == ExpireOverride {
+        return
+    }
+
+    cc := parseCacheControl(resp.Header)
+    if cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache") {
+        return 0, 0
+    }
+    if n, ok := cc.seconds("stale-while-revalidate"); ok {
+        swr = time.Duration(n) * time.Second
+    }
+    if n, ok := cc.seconds("stale-if-error"); ok {
+        sie = time.Duration(n) * time.Second
+    }
+    return
+}
+
+// Whether a response that is stale as soon as it is stored is still
+// worth storing, as one with a validator that is no-cache or that the
+// origin gave no freshness is. Using it costs a 304 from the origin
+// rather than the whole response.
+func (lc *LocationConfig) revalidateOnly(resp *http.Response) bool {
+    if lc.ExpireMode == ExpireOverride {
+        return false
+    }
+    if !parseCacheControl(resp.Header).has("no-cache") {
+        if ttl, ok := originTTL(resp); !ok || ttl > 0 {
+            return false
+        }
+    }
+    return resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// status codes stale-if-error applies to, as listed in RFC 5861
+func originError(code int) bool {
+    switch code {
+    case 500, 502, 503, 504:
+        return true
+    }
+    return false
+}
+
+// entry for a response that is fresh for ttl seconds
+func (lc *LocationConfig) newEntry(req *http.Request, resp *http.Response, data []byte, ttl int) *Entry {
+    e := NewEntry(data, ttl)
+    e.StaleWhileRevalidate, e.StaleIfError = lc.staleWindows(resp)
+    e.Tags = lc.responseTags(resp)
+    e.Host = stripPort(req.Host)
+    e.URL = req.URL.RequestURI()
+    return e
+}
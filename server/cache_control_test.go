@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache-Control", func() {
+
+	var (
+		origin  *httptest.Server
+		lc      *LocationConfig
+		header  http.Header         // sent by the origin
+		hits    int
+		asked   []http.Header       // what the origin was sent
+	)
+
+	BeforeEach(func() {
+		header, hits, asked = make(http.Header), 0, nil
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			asked = append(asked, r.Header.Clone())
+			copyHeader(w.Header(), header)
+			if etag := header.Get("Etag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "response %d", hits)
+		}))
+		lc = testLocation(origin.URL, nil)
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("stores responses the origin made stale for revalidation when they have a validator", func() {
+		for _, c := range []struct {
+			name    string
+			value   string
+			reval   bool
+		}{
+			{"Cache-Control", "no-cache", true},
+			{"Cache-Control", "max-age=0", true},
+			{"Cache-Control", "max-age=0", false},
+			{"Expires", "Thu, 01 Jan 1970 00:00:00 GMT", true},
+		} {
+			lc = testLocation(origin.URL, nil)
+			header, hits, asked = make(http.Header), 0, nil
+			header.Set(c.name, c.value)
+			if c.reval {
+				header.Set("Etag", `"v1"`)
+			}
+
+			Expect(serve(lc, "GET", "/a").Body.String()).To(Equal("response 1"))
+			second := serve(lc, "GET", "/a").Body.String()
+			Expect(hits).To(Equal(2), c.value)
+			if c.reval {
+				Expect(asked[1].Get("If-None-Match")).To(Equal(`"v1"`), c.value)
+				Expect(second).To(Equal("response 1"), c.value)
+			} else {
+				Expect(asked[1].Get("If-None-Match")).To(BeEmpty())
+				Expect(second).To(Equal("response 2"), c.value)
+			}
+		}
+	})
+
+	It("caches responses for as long as the origin says", func() {
+		date := time.Now().UTC()
+		for _, c := range []struct {
+			header  []string
+			mode    string
+			ttl     int             // -1 when not stored
+		}{
+			{nil, "", 60},
+			{[]string{"Cache-Control", "max-age=120"}, "", 120},
+			{[]string{"Cache-Control", "s-maxage=30, max-age=120"}, "", 30},
+			{[]string{"Cache-Control", "max-age=100", "Age", "40"}, "", 60},
+			{[]string{"Expires", date.Add(90 * time.Second).Format(http.TimeFormat), "Date", date.Format(http.TimeFormat)}, "", 90},
+			{[]string{"Cache-Control", "max-age=5"}, ExpireOverride, 60},
+			{[]string{"Cache-Control", "no-store"}, "", -1},
+			{[]string{"Cache-Control", "private, max-age=60"}, "", -1},
+			{[]string{"Set-Cookie", "a=b"}, "", -1},
+			{[]string{"Cache-Control", "max-age=0"}, "", -1},
+		} {
+			lc = testLocation(origin.URL, func(lc *LocationConfig) {
+				if c.mode != "" {
+					lc.ExpireMode = c.mode
+				}
+			})
+			header, hits = make(http.Header), 0
+			for i := 0; i < len(c.header); i += 2 {
+				header.Set(c.header[i], c.header[i + 1])
+			}
+			name := fmt.Sprint(c.header, c.mode)
+
+			_, status := serveStatus(lc, "GET", "/a")
+			Expect(status).To(Equal("MISS"), name)
+			e, _ := cache.Peek("GET example.com/a")
+			if c.ttl < 0 {
+				Expect(e).To(BeNil(), name)
+				continue
+			}
+			Expect(e).NotTo(BeNil(), name)
+			Expect(time.Until(e.Expires).Seconds()).To(BeNumerically("~", c.ttl, 2), name)
+			r, status := serveStatus(lc, "GET", "/a")
+			Expect(status).To(Equal("HIT"), name)
+			Expect(r.Body.String()).To(Equal("response 1"), name)
+		}
+	})
+
+	It("lets clients skip the cache with no-cache", func() {
+		serve(lc, "GET", "/a")
+		r, status := serveStatus(lc, "GET", "/a", "Cache-Control", "no-cache")
+		Expect(status).To(Equal("BYPASS"))
+		Expect(r.Body.String()).To(Equal("response 2"))
+		r, status = serveStatus(lc, "GET", "/a", "Pragma", "no-cache")
+		Expect(status).To(Equal("BYPASS"))
+		Expect(r.Body.String()).To(Equal("response 3"))
+	})
+})
@@ -0,0 +1,161 @@
+package server
+
+import (
+    "sort"
+    "strings"
+    "net/url"
+    "net/http"
+)
+
+// Build the cache key for a request from the location's cache_key
+// template. Besides $scheme, $host, $uri, $querystring and $method,
+// $cookie_NAME is the value of a cookie and $http_HEADER that of a
+// request header, with underscores in HEADER standing for dashes.
+// Unknown variables are left in the key as they are.
+func (lc *LocationConfig) GetCacheKey(r *http.Request) string {
+    var b strings.Builder
+    tmpl := lc.CacheKey
+    for {
+        i := strings.IndexByte(tmpl, '$')
+        if i < 0 {
+            b.WriteString(tmpl)
+            return b.String()
+        }
+        b.WriteString(tmpl[:i])
+        j := i + 1
+        for j < len(tmpl) && isKeyVarByte(tmpl[j]) {
+            j++
+        }
+        if v, ok := lc.keyVariable(r, tmpl[i + 1:j]); ok {
+            b.WriteString(v)
+        } else {
+            b.WriteString(tmpl[i:j])
+        }
+        tmpl = tmpl[j:]
+    }
+}
+
+func isKeyVarByte(c byte) bool {
+    return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (lc *LocationConfig) keyVariable(r *http.Request, name string) (string, bool) {
+    switch {
+    case name == "scheme":
+        return requestScheme(r), true
+    case name == "host":
+        return lc.keyHost(r), true
+    case name == "uri":
+        return r.URL.Path, true
+    case name == "querystring":
+        return lc.keyQuery(r.URL.RawQuery), true
+    case name == "method":
+        return r.Method, true
+    case strings.HasPrefix(name, "cookie_"):
+        if c, err := r.Cookie(name[len("cookie_"):]); err == nil {
+            return c.Value, true
+        }
+        return "", true
+    case strings.HasPrefix(name, "http_"):
+        return r.Header.Get(strings.Replace(name[len("http_"):], "_", "-", -1)), true
+    }
+    return "", false
+}
+
+// Requests to the server don't have r.URL.Scheme set, so it's
+// only used for requests built to look up keys, such as purges
+func requestScheme(r *http.Request) string {
+    if r.URL.Scheme != "" {
+        return r.URL.Scheme
+    }
+    if r.TLS != nil {
+        return "https"
+    }
+    return "http"
+}
+
+// the host, lowercased and without the scheme's default port if configured
+func (lc *LocationConfig) keyHost(r *http.Request) string {
+    host := r.Host
+    if lc.KeyLowercaseHost {
+        host = strings.ToLower(host)
+    }
+    if lc.KeyStripDefaultPort {
+        if requestScheme(r) == "https" {
+            host = strings.TrimSuffix(host, ":443")
+        } else {
+            host = strings.TrimSuffix(host, ":80")
+        }
+    }
+    return host
+}
+
+// The query string with parameters filtered through the include and
+// exclude lists and, if configured, sorted. Parameters keep their
+// original encoding, and the query is untouched without any options.
+func (lc *LocationConfig) keyQuery(raw string) string {
+    if raw == "" || !lc.KeySortQuery && len(lc.KeyQueryInclude) == 0 && len(lc.KeyQueryExclude) == 0 {
+        return raw
+    }
+    params := make([]string, 0)
+    names := make(map[string]string)
+    for _, p := range strings.Split(raw, "&") {
+        if p == "" {
+            continue
+        }
+        name := p
+        if i := strings.IndexByte(p, '='); i >= 0 {
+            name = p[:i]
+        }
+        if n, err := url.QueryUnescape(name); err == nil {
+            name = n
+        }
+        if len(lc.KeyQueryInclude) > 0 && !matchParam(lc.KeyQueryInclude, name) {
+            continue
+        }
+        if matchParam(lc.KeyQueryExclude, name) {
+            continue
+        }
+        params = append(params, p)
+        names[p] = name
+    }
+    if lc.KeySortQuery {
+        // by name, keeping the order of repeated parameters
+        sort.SliceStable(params, func(i, j int) bool {
+            return names[params[i]] < names[params[j]]
+        })
+    }
+    return strings.Join(params, "&")
+}
+
+// whether name is in the list, where entries ending in * match by prefix
+func matchParam(list []string, name string) bool {
+    for _, p := range list {
+        if strings.HasSuffix(p, "*") {
+            if strings.HasPrefix(name, p[:len(p) - 1]) {
+                return true
+            }
+        } else if p == name {
+            return true
+        }
+    }
+    return false
+}
+
+// the key a GET request for u is cached under, built from u as the
+// proxy sees requests, with only the path and query in the request URL.
+// Only of use when the key doesn't depend on the request headers.
+func (lc *LocationConfig) urlCacheKey(u *url.URL) string {
+    req := &http.Request{
+        Method: "GET",
+        Host: u.Host,
+        URL: &url.URL{Scheme: u.Scheme, Path: u.Path, RawQuery: u.RawQuery},
+        Header: make(http.Header),
+    }
+    return lc.GetCacheKey(req)
+}
+
+// whether the cache_key template uses cookies or request headers
+func (lc *LocationConfig) keyUsesHeaders() bool {
+    return strings.Contains(lc.CacheKey, "$cookie_") || strings.Contains(lc.CacheKey, "$http_")
+}
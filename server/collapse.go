@@ -0,0 +1,209 @@
+package server
+
+import (
+    "io"
+    "sync"
+    "time"
+    "errors"
+    "net/http"
+)
+
+// how long collapsed requests wait for the leader's response
+// headers when the location doesn't set collapse_timeout
+const defaultCollapseTimeout = 10
+
+var (
+    // the leader's response can't be cached, so isn't shared
+    errNotShared        = errors.New("response is not shared")
+    errCollapseTimeout  = errors.New("timed out waiting for collapsed request")
+)
+
+// Requests to the origin in flight for each cache key. The first
+// request for a key leads and the rest wait on its Target, reading
+// the response as the leader receives it rather than once it's done.
+type ActiveRequests struct{
+    Lock    sync.Mutex
+    Targets map[string]*Target
+    MaxSize int64       // of a body held for waiters, 0 for no limit
+}
+
+// A request to the origin that others can follow. The leader
+// publishes the response headers with Respond, appends the body
+// with Write and ends it with Finish, passing any error it hit.
+type Target struct {
+    key     string
+    ar      *ActiveRequests
+    lock    sync.Mutex
+    cond    *sync.Cond
+    resp    *http.Response
+    data    []byte
+    done    bool
+    err     error
+}
+
+// Returns the target for key and whether the caller is its leader.
+// Leaders must always call Finish on the target.
+func (ar *ActiveRequests) Start(key string) (*Target, bool) {
+    ar.Lock.Lock()
+    defer ar.Lock.Unlock()
+    if t, ok := ar.Targets[key]; ok {
+        return t, false
+    }
+    return ar.add(key), true
+}
+
+// Like Start, but only returns a target when the
+// caller leads it, never waiting on another request
+func (ar *ActiveRequests) TryStart(key string) *Target {
+    ar.Lock.Lock()
+    defer ar.Lock.Unlock()
+    if _, ok := ar.Targets[key]; ok {
+        return nil
+    }
+    return ar.add(key)
+}
+
+// must be called with the lock held
+func (ar *ActiveRequests) add(key string) *Target {
+    t := &Target{
+        key:    key,
+        ar:     ar,
+    }
+    t.cond = sync.NewCond(&t.lock)
+    ar.Targets[key] = t
+    return t
+}
+
+// publish the status and headers of the response
+func (t *Target) Respond(resp *http.Response) {
+    r := new(http.Response)
+    *r = *resp
+    r.Header = resp.Header.Clone()
+    r.Body = nil
+
+    t.lock.Lock()
+    t.resp = r
+    t.lock.Unlock()
+    t.cond.Broadcast()
+}
+
+// Append to the body of the response. A body growing past the
+// size limit is no longer shared, and the waiters fail.
+func (t *Target) Write(p []byte) (int, error) {
+    max := t.ar.MaxSize
+    t.lock.Lock()
+    if t.done || (max > 0 && int64(len(t.data) + len(p)) > max) {
+        t.lock.Unlock()
+        t.Finish(errNotShared)
+        return 0, errNotShared
+    }
+    t.data = append(t.data, p...)
+    t.lock.Unlock()
+    t.cond.Broadcast()
+    return len(p), nil
+}
+
+// the body written so far, which is the whole body once
+// the leader has finished it without an error
+func (t *Target) Body() []byte {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    return t.data
+}
+
+// Mark the response complete, or failed if err is set. The key is
+// released first, so new requests for it go to the cache again.
+// Only the first call counts.
+func (t *Target) Finish(err error) {
+    t.ar.Lock.Lock()
+    if t.ar.Targets[t.key] == t {
+        delete(t.ar.Targets, t.key)
+    }
+    t.ar.Lock.Unlock()
+
+    t.lock.Lock()
+    if !t.done {
+        t.done = true
+        t.err = err
+    }
+    t.lock.Unlock()
+    t.cond.Broadcast()
+}
+
+// publish a response that has already been read in full
+func (t *Target) Complete(resp *http.Response, body []byte) {
+    t.Respond(resp)
+    t.Write(body)
+    t.Finish(nil)
+}
+
+// Wait up to d for the leader's response. Its body can be read as
+// the leader receives it. If the leader failed, its error is returned.
+func (t *Target) Wait(d time.Duration) (*http.Response, error) {
+    // the wakeup is sent under the lock, so it can't fall between
+    // checking the deadline and starting to wait, and no earlier
+    // than the deadline
+    deadline := time.Now().Add(d)
+    timer := time.AfterFunc(time.Until(deadline), func() {
+        t.lock.Lock()
+        defer t.lock.Unlock()
+        t.cond.Broadcast()
+    })
+    defer timer.Stop()
+
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    for t.resp == nil && !t.done {
+        if !time.Now().Before(deadline) {
+            return nil, errCollapseTimeout
+        }
+        t.cond.Wait()
+    }
+    if t.resp == nil {
+        if t.err == nil {
+            return nil, errNotShared
+        }
+        return nil, t.err
+    }
+    r := new(http.Response)
+    *r = *t.resp
+    r.Header = t.resp.Header.Clone()
+    r.Body = &targetReader{t: t}
+    return r, nil
+}
+
+// reads a target's body from the start, blocking for more
+// until the leader finishes
+type targetReader struct {
+    t       *Target
+    off     int
+}
+
+func (r *targetReader) Read(p []byte) (int, error) {
+    t := r.t
+    t.lock.Lock()
+    defer t.lock.Unlock()
+    for r.off >= len(t.data) && !t.done {
+        t.cond.Wait()
+    }
+    if r.off < len(t.data) {
+        n := copy(p, t.data[r.off:])
+        r.off += n
+        return n, nil
+    }
+    if t.err != nil {
+        return 0, t.err
+    }
+    return 0, io.EOF
+}
+
+func (r *targetReader) Close() error {
+    return nil
+}
+
+func (lc *LocationConfig) collapseTimeout() time.Duration {
+    if lc.CollapseTimeout > 0 {
+        return time.Duration(lc.CollapseTimeout) * time.Second
+    }
+    return defaultCollapseTimeout * time.Second
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+    "time"
+    "strings"
+    "net/http"
+)
+
+// Headers sent along with a 304 Not Modified, RFC 9110 section 15.4.5
+var notModifiedHeaders = []string{
+    "Cache-Control",
+    "Content-Location",
+    "Date",
+    "Etag",
+    "Expires",
+    "Last-Modified",
+    "Vary",
+}
+
+// Evaluate the client's conditional headers against a response served
+// from the cache, following the order in RFC 9110 section 13.2.2.
+// Returns 304 or 412 when the response should be replaced by one of
+// those, or 0 when it should be sent as is.
+func checkConditions(req *http.Request, resp *http.Response) int {
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return 0
+    }
+    etag := resp.Header.Get("Etag")
+    lastModified, lmErr := http.ParseTime(resp.Header.Get("Last-Modified"))
+    safe := req.Method == "GET" || req.Method == "HEAD"
+
+    if im := req.Header.Get("If-Match"); im != "" {
+        if !etagMatches(im, etag, false) {
+            return http.StatusPreconditionFailed
+        }
+    } else if ius := req.Header.Get("If-Unmodified-Since"); ius != "" && lmErr == nil {
+        if t, err := http.ParseTime(ius); err == nil && lastModified.After(t) {
+            return http.StatusPreconditionFailed
+        }
+    }
+
+    if inm := req.Header.Get("If-None-Match"); inm != "" {
+        if etagMatches(inm, etag, true) {
+            if safe {
+                return http.StatusNotModified
+            }
+            return http.StatusPreconditionFailed
+        }
+    } else if ims := req.Header.Get("If-Modified-Since"); ims != "" && safe && lmErr == nil {
+        if t, err := http.ParseTime(ims); err == nil && !lastModified.Truncate(time.Second).After(t) {
+            return http.StatusNotModified
+        }
+    }
+    return 0
+}
+
+// Whether etag is in the comma separated list of entity tags. Weak
+// comparison ignores the W/ prefix, strong comparison never matches
+// a weak tag. "*" matches any current representation.
+func etagMatches(list, etag string, weak bool) bool {
+    if strings.TrimSpace(list) == "*" {
+        return true
+    }
+    if etag == "" {
+        return false
+    }
+    if !weak && strings.HasPrefix(etag, "W/") {
+        return false
+    }
+    for _, t := range strings.Split(list, ",") {
+        t = strings.TrimSpace(t)
+        if weak {
+            t = strings.TrimPrefix(t, "W/")
+            if t == strings.TrimPrefix(etag, "W/") {
+                return true
+            }
+        } else if t == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// answer a conditional request without a body
+func respondConditional(res *http.Response, rw http.ResponseWriter, code int) {
+    if code == http.StatusNotModified {
+        for _, h := range notModifiedHeaders {
+            if vv, ok := res.Header[h]; ok {
+                rw.Header()[h] = vv
+            }
+        }
+    }
+    rw.WriteHeader(code)
+}
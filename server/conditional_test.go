@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Conditional requests", func() {
+
+	It("evaluates the client's preconditions against a cached response", func() {
+		lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+		for _, c := range []struct {
+			method  string
+			etag    string
+			header  string
+			value   string
+			want    int
+		}{
+			{"GET", `"v1"`, "If-None-Match", `"v1"`, http.StatusNotModified},
+			{"GET", `"v1"`, "If-None-Match", `"v2", "v1"`, http.StatusNotModified},
+			{"GET", `W/"v1"`, "If-None-Match", `"v1"`, http.StatusNotModified},
+			{"GET", `"v1"`, "If-None-Match", `"v2"`, 0},
+			{"GET", "", "If-None-Match", `"v1"`, 0},
+			{"GET", "", "If-None-Match", "*", http.StatusNotModified},
+			{"PUT", "", "If-None-Match", "*", http.StatusPreconditionFailed},
+			{"GET", `"v1"`, "If-Match", `"v1"`, 0},
+			{"GET", `W/"v1"`, "If-Match", `W/"v1"`, http.StatusPreconditionFailed},
+			{"GET", `"v1"`, "If-Match", `"v2"`, http.StatusPreconditionFailed},
+			{"GET", "", "If-Match", "*", 0},
+			{"GET", "", "If-Match", `"v1"`, http.StatusPreconditionFailed},
+			{"GET", "", "If-Modified-Since", lastModified, http.StatusNotModified},
+			{"GET", "", "If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", 0},
+			{"GET", "", "If-Unmodified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", http.StatusPreconditionFailed},
+		} {
+			req := httptest.NewRequest(c.method, "/", nil)
+			req.Header.Set(c.header, c.value)
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+			resp.Header.Set("Last-Modified", lastModified)
+			if c.etag != "" {
+				resp.Header.Set("Etag", c.etag)
+			}
+			Expect(checkConditions(req, resp)).To(Equal(c.want), c.method + " " + c.etag + " " + c.header + ": " + c.value)
+		}
+	})
+
+	Describe("through the proxy", func() {
+
+		var (
+			origin  *httptest.Server
+			lc      *LocationConfig
+			methods []string
+		)
+
+		BeforeEach(func() {
+			methods = nil
+			origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				methods = append(methods, r.Method)
+				if r.URL.Path == "/a" {
+					w.Header().Set("Etag", `"v1"`)
+				}
+				w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+				fmt.Fprint(w, "response")
+			}))
+			lc = testLocation(origin.URL, nil)
+		})
+
+		AfterEach(func() {
+			origin.Close()
+		})
+
+		It("answers the client's conditionals from the cache", func() {
+			for _, c := range []struct {
+				path    string
+				header  []string
+				code    int
+			}{
+				{"/a", nil, http.StatusOK},
+				{"/a", []string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+				{"/a", []string{"If-None-Match", `W/"v1"`}, http.StatusNotModified},
+				{"/a", []string{"If-None-Match", `"v2"`}, http.StatusOK},
+				{"/a", []string{"If-Match", `"v2"`}, http.StatusPreconditionFailed},
+				{"/a", []string{"If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusNotModified},
+				{"/a", []string{"If-Unmodified-Since", "Sun, 01 Jan 2006 15:04:05 GMT"}, http.StatusPreconditionFailed},
+				{"/b", nil, http.StatusOK},
+				{"/b", []string{"If-None-Match", "*"}, http.StatusNotModified},
+				{"/b", []string{"If-Match", "*"}, http.StatusOK},
+			} {
+				r := serve(lc, "GET", c.path, c.header...)
+				name := fmt.Sprint(c.path, c.header)
+				Expect(r.Code).To(Equal(c.code), name)
+				if c.code == http.StatusNotModified {
+					Expect(r.Body.Len()).To(BeZero(), name)
+					Expect(r.Header().Get("Last-Modified")).NotTo(BeEmpty(), name)
+				}
+			}
+			Expect(methods).To(Equal([]string{"GET", "GET"}))
+		})
+
+		It("answers HEAD from the cached GET", func() {
+			r, status := serveStatus(lc, "HEAD", "/a")
+			Expect(status).To(Equal("MISS"))
+			Expect(r.Code).To(Equal(http.StatusOK))
+			r, status = serveStatus(lc, "HEAD", "/a")
+			Expect(status).To(Equal("HIT"))
+			Expect(r.Header().Get("Etag")).To(Equal(`"v1"`))
+			Expect(r.Header().Get("Content-Length")).To(Equal("8"))
+			_, status = serveStatus(lc, "GET", "/a")
+			Expect(status).To(Equal("HIT"))
+			Expect(serve(lc, "HEAD", "/a", "If-None-Match", `"v1"`).Code).To(Equal(http.StatusNotModified))
+			Expect(methods).To(Equal([]string{"GET"}))
+		})
+	})
+})
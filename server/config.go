@@ -3,21 +3,57 @@ package server
 import(
     "os"
     "log"
+    "net"
     "errors"
-    "net/url"
+    "strings"
+    "net/http"
     "io/ioutil"
     "encoding/json"
-    "net/http/httputil"
 )
 
 type LocationConfig struct {
-    Origin          string                  `json:"origin"`
-    CacheKey        string                  `json:"cache_key"`
-    Expire          int                     `json:"expire"`
-    SetHeader       map[string]string       `json:"set_header"`
-    ByPass          bool                    `json:"cache_bypass"`
-    Proxy           *httputil.ReverseProxy  `json:"-"`
-    ActiveRequests  *ActiveRequests         `json:"-"`
+    Origin                  string                  `json:"origin"`
+    Origins                 []OriginConfig          `json:"origins"`
+    Balance                 string                  `json:"balance"`
+    HealthCheck             *HealthCheckConfig      `json:"health_check"`
+    MaxFails                int                     `json:"max_fails"`
+    FailTimeout             int                     `json:"fail_timeout"`
+    Retries                 int                     `json:"retries"`
+    RetryBackoff            int                     `json:"retry_backoff"`
+    RetryOnStatus           []int                   `json:"retry_on_status"`
+    RetryBudget             float64                 `json:"retry_budget"`
+    RetryBudgetMin          int                     `json:"retry_budget_min"`
+    ConnectTimeout          int                     `json:"connect_timeout"`
+    TLSHandshakeTimeout     int                     `json:"tls_handshake_timeout"`
+    ResponseHeaderTimeout   int                     `json:"response_header_timeout"`
+    IdleConnTimeout         int                     `json:"idle_conn_timeout"`
+    KeepAlive               int                     `json:"keepalive"`
+    DisableKeepAlives       bool                    `json:"disable_keepalives"`
+    MaxIdleConns            int                     `json:"max_idle_conns"`
+    MaxIdleConnsPerHost     int                     `json:"max_idle_conns_per_host"`
+    MaxConnsPerHost         int                     `json:"max_conns_per_host"`
+    CircuitBreaker          *BreakerConfig          `json:"circuit_breaker"`
+    CacheKey                string                  `json:"cache_key"`
+    Expire                  int                     `json:"expire"`
+    ExpireMode              string                  `json:"expire_mode"`
+    StaleWhileRevalidate    int                     `json:"stale_while_revalidate"`
+    StaleIfError            int                     `json:"stale_if_error"`
+    SetHeader               map[string]string       `json:"set_header"`
+    ByPass                  bool                    `json:"cache_bypass"`
+    VaryNormalize           map[string][]string     `json:"vary_normalize"`
+    SliceSize               int64                   `json:"slice_size"`
+    MaxObjectSize           int64                   `json:"max_object_size"`
+    CollapseTimeout         int                     `json:"collapse_timeout"`
+    TagHeaders              []string                `json:"tag_headers"`
+    PurgeACL                []string                `json:"purge_acl"`
+    KeySortQuery            bool                    `json:"cache_key_sort_query"`
+    KeyQueryInclude         []string                `json:"cache_key_query_include"`
+    KeyQueryExclude         []string                `json:"cache_key_query_exclude"`
+    KeyLowercaseHost        bool                    `json:"cache_key_lowercase_host"`
+    KeyStripDefaultPort     bool                    `json:"cache_key_strip_default_port"`
+    Pool                    *OriginPool             `json:"-"`
+    ActiveRequests          *ActiveRequests         `json:"-"`
+    PurgeNets               []*net.IPNet            `json:"-"`
 }
 
 // config for a vhost
@@ -36,17 +72,26 @@ type LogConfig struct {
     Verbose     bool        `json:"verbose"`
 }
 
+// Configuration settings for the cache, Type selects the backend.
+// Path is the directory used by the disk backend. The tiered backend
+// uses Size for its memory tier and DiskSize for its disk tier.
+type CacheConfig struct {
+    Type        string      `json:"type"`
+    Size        int64       `json:"size"`
+    Path        string      `json:"path"`
+    DiskSize    int64       `json:"disk_size"`
+}
+
 // Global Config structure
 type Config struct {
-    Server      string        
-    Port        int
-    Cache   struct{
-        Type    string
-        Size    int
-    }
-    Logs        []LogConfig             `json:"logs"`
-    SetHeader   map[string]string       `json:"set_header"`
-    VhostPath   string                  `json:"vhostpath"`
+    Server          string
+    Port            int
+    Cache           CacheConfig             `json:"cache"`
+    Logs            []LogConfig             `json:"logs"`
+    SetHeader       map[string]string       `json:"set_header"`
+    VhostPath       string                  `json:"vhostpath"`
+    ReadTimeout     int                     `json:"read_timeout"`
+    WriteTimeout    int                     `json:"write_timeout"`
 }
 
 // hashmap of vhost to config
@@ -103,14 +148,32 @@ func getConfig(path string) error {
     }
     
     for path, cfg := range config.Location {
-        remote, err := url.Parse(cfg.Origin)
+        pool, err := newOriginPool(cfg)
         if err != nil {
-            return err
+            return errors.New("Invalid origins for location " + path + ": " + err.Error())
+        }
+        switch cfg.ExpireMode {
+        case "":
+            cfg.ExpireMode = ExpireOrigin
+        case ExpireOrigin, ExpireOverride:
+        default:
+            return errors.New("Unknown expire_mode " + cfg.ExpireMode + " for location " + path)
+        }
+        normalize := make(map[string][]string)
+        for name, values := range cfg.VaryNormalize {
+            normalize[http.CanonicalHeaderKey(name)] = values
+        }
+        cfg.VaryNormalize = normalize
+        nets, err := parseACL(cfg.PurgeACL)
+        if err != nil {
+            return errors.New("Invalid purge_acl for location " + path + ": " + err.Error())
         }
+        cfg.PurgeNets = nets
 
-        config.Location[path].Proxy = httputil.NewSingleHostReverseProxy(remote)
+        config.Location[path].Pool = pool
         config.Location[path].ActiveRequests = &ActiveRequests{
             Targets: make(map[string]*Target),
+            MaxSize: cfg.MaxObjectSize,
         }
     }
 
@@ -141,4 +204,32 @@ func loadVhosts(dir string) error {
         }
     }
     return nil
-}
\ No newline at end of file
+}
+
+// host without the port, as vhosts are matched on
+func stripPort(host string) string {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        return h
+    }
+    return host
+}
+
+// Location of a vhost that a request for path is handled by. Like
+// http.ServeMux, locations ending in a slash match every path below
+// them and the longest match wins.
+func findLocation(host, path string) *LocationConfig {
+    v, ok := vHosts[stripPort(host)]
+    if !ok {
+        return nil
+    }
+    var lc *LocationConfig
+    longest := -1
+    for loc, cfg := range v.Location {
+        if loc == path || strings.HasSuffix(loc, "/") && strings.HasPrefix(path, loc) {
+            if len(loc) > longest {
+                lc, longest = cfg, len(loc)
+            }
+        }
+    }
+    return lc
+}
@@ -109,12 +109,65 @@ func registerCommands() {
             return
         },
     }
+
+    registerPurgeCommands()
+    registerCacheCommands()
+    registerWarmCommands()
+    registerSnapshotCommands()
+    registerOriginCommands()
+}
+
+// A subcommand of a command family, whose usage is the family, name
+// and args. It fails with that usage when given fewer than min args,
+// not counting any of flags, which the family passes on ahead of them.
+func subcommand(family, name, args string, min int, action func(args []string) (string, error), flags ...string) *Command {
+    usage := strings.TrimSpace(family + " " + name + " " + args)
+    isFlag := make(map[string]bool)
+    for _, f := range flags {
+        isFlag[f] = true
+    }
+    return &Command{
+        name,
+        usage,
+        []string{},
+        map[string]*Command{},
+        func(context []string) (reply string, err error) {
+            n := 0
+            for n < len(context) && isFlag[context[n]] {
+                n++
+            }
+            if len(context) - n < min {
+                return "", errors.New("Usage: " + usage)
+            }
+            return action(context)
+        },
+    }
+}
+
+// run the subcommand of the family named by the first argument
+func runSubcommand(family string, context []string) (string, error) {
+    if len(context) == 0 {
+        return "", errors.New("Usage: " + cmds[family].Usage)
+    }
+    if sub, ok := cmds[family].Subcommands[context[0]]; ok {
+        return sub.Action(context[1:])
+    }
+    return "", errors.New("Unknown " + family + " command " + context[0] + ".")
+}
+
+// an action that fails while the cache isn't running
+func withCache(action func(args []string) (string, error)) func(args []string) (string, error) {
+    return func(args []string) (string, error) {
+        if cache == nil {
+            return "", errNoCache
+        }
+        return action(args)
+    }
 }
 
 func handleCmd(cmd string, c *Client) (string, error) {
-    cmd = strings.Trim(cmd, "\n")
-    tokens := strings.Split(cmd, " ")
-    if len(tokens) == 1 && tokens[0] == "" {
+    tokens := strings.Fields(cmd)
+    if len(tokens) == 0 {
         return "", nil
     }
     if _, ok := cmds[tokens[0]]; !ok {
@@ -169,7 +222,7 @@ func startCommunication(c *Client, k chan bool, wg *sync.WaitGroup) {
     defer c.TCP.Close()
     log.Println("Connection Established:", c.TCP.RemoteAddr().String())
 
-    fmt.Fprintf(c.BWriter, "Connection established to " + c.TCP.LocalAddr().String() + "\n")
+    fmt.Fprint(c.BWriter, "Connection established to ", c.TCP.LocalAddr().String(), "\n")
     c.BWriter.Flush()
 
     go func() {
@@ -192,9 +245,9 @@ func startCommunication(c *Client, k chan bool, wg *sync.WaitGroup) {
         resp, err := handleCmd(cmd, c)
         resp = strings.Trim(resp, "\n")
         if err != nil {
-            fmt.Fprintf(c.BWriter, err.Error() + "\r\n")
+            fmt.Fprint(c.BWriter, err.Error(), "\r\n")
         } else {
-            fmt.Fprintf(c.BWriter, resp + "\r\n")
+            fmt.Fprint(c.BWriter, resp, "\r\n")
         }
         c.BWriter.Flush()
     }
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"bufio"
+	"strings"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admin connection", func() {
+
+	It("sends replies as they are", func() {
+		if cmds == nil {
+			cmds = make(map[string]*Command)
+		}
+		cmds["echo"] = &Command{Name: "echo", Action: func(args []string) (string, error) {
+			return strings.Join(args, " "), nil
+		}}
+		defer delete(cmds, "echo")
+
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.AcceptTCP()
+			Expect(err).NotTo(HaveOccurred())
+			c := &Client{conn, bufio.NewWriter(conn), bufio.NewReader(conn), "test"}
+			startCommunication(c, make(chan bool), &wg)
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		r := bufio.NewReader(conn)
+		_, err = r.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+
+		conn.Write([]byte("echo Hit ratio: 50.00% /a%20b %s\n"))
+		line, err := r.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("Hit ratio: 50.00% /a%20b %s\r\n"))
+		conn.Close()
+		wg.Wait()
+	})
+
+	It("runs subcommands of a command family", func() {
+		if cmds == nil {
+			cmds = make(map[string]*Command)
+		}
+		echo := func(args []string) (string, error) {
+			return strings.Join(args, ","), nil
+		}
+		cmds["family"] = &Command{
+			"family",
+			"family [-f] one|two ...",
+			[]string{},
+			map[string]*Command{
+				"one": subcommand("family", "one", "", 0, echo),
+				"two": subcommand("family [-f]", "two", "<a> <b>", 2, echo, "-f"),
+			},
+			func(context []string) (string, error) {
+				return runSubcommand("family", context)
+			},
+		}
+		defer delete(cmds, "family")
+
+		for _, c := range []struct {
+			cmd     string
+			reply   string
+			err     string
+		}{
+			{"family", "", "Usage: family [-f] one|two ..."},
+			{"family three", "", "Unknown family command three."},
+			{"family one", "", ""},
+			{"family one a b", "a,b", ""},
+			{"family two a", "", "Usage: family [-f] two <a> <b>"},
+			{"family two -f a", "", "Usage: family [-f] two <a> <b>"},
+			{"family two -f a b", "-f,a,b", ""},
+		} {
+			reply, err := handleCmd(c.cmd, nil)
+			if c.err != "" {
+				Expect(err).To(MatchError(c.err), c.cmd)
+			} else {
+				Expect(err).NotTo(HaveOccurred(), c.cmd)
+			}
+			Expect(reply).To(Equal(c.reply), c.cmd)
+		}
+	})
+})
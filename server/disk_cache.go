@@ -0,0 +1,573 @@
+package server
+
+import (
+    "os"
+    "io"
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "crypto/sha1"
+    "encoding/hex"
+    "path/filepath"
+    "encoding/json"
+    "container/list"
+)
+
+// Cache backend keeping each response in its own file under Path.
+// The index of keys is held in memory and rebuilt from the files on
+// startup, so a restart doesn't start over with a cold cache.
+// Files are written to a temporary name and renamed into place, so
+// a crash mid-write only ever leaves behind a file that is ignored.
+// The rename happens with the lock held, so a key's file and its
+// index entry only ever change together. Files are only read and
+// written without the lock.
+type DiskCache struct {
+    Path        string
+    MaxSize     int64
+    lock        sync.Mutex
+    data        map[string]*list.Element
+    lru         *list.List
+    size        int64
+    stats       CacheStats
+    tags        *tagIndex
+    gen         uint64      // last generation given to an item
+}
+
+type diskItem struct {
+    key         string
+    file        string
+    size        int64
+    hits        int64
+    header      diskHeader
+    gen         uint64      // new whenever the item's file is replaced
+}
+
+// written as a single JSON line at the start of every cache file
+type diskHeader struct {
+    Key                     string      `json:"key"`
+    Expires                 int64       `json:"expires"`
+    StaleWhileRevalidate    int64       `json:"stale_while_revalidate"`
+    StaleIfError            int64       `json:"stale_if_error"`
+    Tags                    []string    `json:"tags,omitempty"`
+    Host                    string      `json:"host,omitempty"`
+    URL                     string      `json:"url,omitempty"`
+    Length                  int64       `json:"length"`
+}
+
+const diskTmpSuffix = ".tmp"
+
+// an item was replaced or removed while its file was being rewritten
+var errDiskItemChanged = errors.New("cache file was replaced")
+
+func init() {
+    RegisterCacheBackend("disk", func(cfg CacheConfig) (CacheBackend, error) {
+        return NewDiskCache(cfg.Path, cfg.Size)
+    })
+}
+
+func NewDiskCache(path string, size int64) (*DiskCache, error) {
+    if path == "" {
+        return nil, errors.New("Disk cache requires cache.path to be set")
+    }
+    if size <= 0 {
+        size = defaultCacheSize
+    }
+    if err := os.MkdirAll(path, 0755); err != nil {
+        return nil, err
+    }
+    c := &DiskCache{
+        Path: path,
+        MaxSize: size,
+        data: make(map[string]*list.Element),
+        lru: list.New(),
+        tags: newTagIndex(),
+    }
+    if err := c.load(); err != nil {
+        return nil, err
+    }
+
+    go c.scheduleCleaner(60 * time.Second)
+    return c, nil
+}
+
+func (c *DiskCache) scheduleCleaner(d time.Duration) {
+    t := time.Tick(d)
+    for {
+        <-t
+        c.PurgeExpired()
+    }
+}
+
+// files are spread over 256 directories named after
+// the first byte of the hashed key
+func (c *DiskCache) fileName(key string) string {
+    sum := sha1.Sum([]byte(key))
+    h := hex.EncodeToString(sum[:])
+    return filepath.Join(c.Path, h[:2], h)
+}
+
+// Rebuild the index from the files already on disk. Leftover
+// temporary files and files that are truncated or unreadable
+// are removed. Files are added oldest first so the most recently
+// written end up at the front of the LRU list.
+func (c *DiskCache) load() error {
+    items := make([]*diskItem, 0)
+    modTimes := make(map[*diskItem]time.Time)
+
+    err := filepath.Walk(c.Path, func(path string, fi os.FileInfo, err error) error {
+        if err != nil || fi.IsDir() {
+            return err
+        }
+        if strings.HasSuffix(path, diskTmpSuffix) {
+            os.Remove(path)
+            return nil
+        }
+        di, err := readDiskItem(path, fi.Size())
+        if err != nil {
+            log.Println("Removing unreadable cache file", path + ":", err)
+            os.Remove(path)
+            return nil
+        }
+        items = append(items, di)
+        modTimes[di] = fi.ModTime()
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        return modTimes[items[i]].Before(modTimes[items[j]])
+    })
+    for _, di := range items {
+        if e, ok := c.data[di.key]; ok {
+            c.remove(e)
+        }
+        c.insert(di)
+    }
+    c.makeRoom(nil)
+    log.Println("Loaded", len(c.data), "objects from disk cache", c.Path)
+    return nil
+}
+
+// read just the header of a cache file and check it against the file size
+func readDiskItem(path string, size int64) (*diskItem, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    line, err := bufio.NewReader(f).ReadBytes('\n')
+    if err != nil {
+        return nil, err
+    }
+    var h diskHeader
+    if err := json.Unmarshal(line, &h); err != nil {
+        return nil, err
+    }
+    if int64(len(line)) + h.Length != size {
+        return nil, errors.New("cache file is incomplete")
+    }
+    return &diskItem{
+        key:        h.Key,
+        file:       path,
+        size:       size,
+        header:     h,
+    }, nil
+}
+
+// the entry described by a header, without its response
+func (h diskHeader) entry() *Entry {
+    return &Entry{
+        Expires:                time.Unix(h.Expires, 0),
+        StaleWhileRevalidate:   time.Duration(h.StaleWhileRevalidate) * time.Second,
+        StaleIfError:           time.Duration(h.StaleIfError) * time.Second,
+        Tags:                   h.Tags,
+        Host:                   h.Host,
+        URL:                    h.URL,
+    }
+}
+
+// read the header and the response stored in a cache file
+func readDiskResponse(path string) (h diskHeader, b []byte, err error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return h, nil, err
+    }
+    defer f.Close()
+
+    br := bufio.NewReader(f)
+    line, err := br.ReadBytes('\n')
+    if err != nil {
+        return h, nil, err
+    }
+    if err = json.Unmarshal(line, &h); err != nil {
+        return h, nil, err
+    }
+    b = make([]byte, h.Length)
+    if _, err = io.ReadFull(br, b); err != nil {
+        return h, nil, err
+    }
+    return h, b, nil
+}
+
+func (c *DiskCache) Get(key string) (*Entry, string) {
+    c.lock.Lock()
+    e, ok := c.data[key]
+    if !ok {
+        c.stats.Misses++
+        c.lock.Unlock()
+        return nil, "MISS"
+    }
+    c.lru.MoveToFront(e)
+    di := e.Value.(*diskItem)
+    di.hits++
+    if di.header.entry().expired() {
+        c.stats.Misses++
+    } else {
+        c.stats.Hits++
+    }
+    c.lock.Unlock()
+
+    // the file may have been replaced since, its own header goes with it
+    h, b, err := readDiskResponse(di.file)
+    if err != nil {
+        log.Println("Error reading cache file:", err)
+        c.deleteItem(di)
+        return nil, "MISS"
+    }
+    entry := h.entry()
+    entry.Response = b
+    if entry.expired() {
+        return entry, "EXPIRED"
+    }
+    return entry, "HIT"
+}
+
+// the header describing an entry stored under key
+func newDiskHeader(key string, entry *Entry) diskHeader {
+    return diskHeader{
+        Key:                    key,
+        Expires:                entry.Expires.Unix(),
+        StaleWhileRevalidate:   int64(entry.StaleWhileRevalidate / time.Second),
+        StaleIfError:           int64(entry.StaleIfError / time.Second),
+        Tags:                   entry.Tags,
+        Host:                   entry.Host,
+        URL:                    entry.URL,
+        Length:                 int64(len(entry.Response)),
+    }
+}
+
+func (c *DiskCache) Set(key string, entry *Entry) {
+    h := newDiskHeader(key, entry)
+    line, err := json.Marshal(h)
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    line = append(line, '\n')
+    di := &diskItem{
+        key:        key,
+        file:       c.fileName(key),
+        size:       int64(len(line) + len(entry.Response)),
+        header:     h,
+    }
+    if di.size > c.MaxSize {
+        c.lock.Lock()
+        c.stats.Rejected++
+        c.lock.Unlock()
+        return
+    }
+
+    tmp, err := writeDiskTmp(di.file, line, entry.Response)
+    if err != nil {
+        log.Println("Error writing cache file:", err)
+        return
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if err := os.Rename(tmp, di.file); err != nil {
+        log.Println("Error writing cache file:", err)
+        os.Remove(tmp)
+        return
+    }
+    c.insert(di)
+    c.makeRoom(di)
+}
+
+// Write a file to a temporary name next to path, to be renamed into
+// place with the lock held, so the final name only ever refers to a
+// complete file
+func writeDiskTmp(path string, header, data []byte) (string, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return "", err
+    }
+    f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".*" + diskTmpSuffix)
+    if err != nil {
+        return "", err
+    }
+    if _, err = f.Write(header); err == nil {
+        _, err = f.Write(data)
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return "", err
+    }
+    return f.Name(), nil
+}
+
+// Add an item to the index in place of any item with the same key,
+// whose file it has already replaced. Must be called with the lock held.
+func (c *DiskCache) insert(di *diskItem) {
+    if e, ok := c.data[di.key]; ok {
+        old := e.Value.(*diskItem)
+        c.lru.Remove(e)
+        c.size -= old.size
+        c.tags.remove(old.key, old.header.Tags)
+    }
+    c.gen++
+    di.gen = c.gen
+    c.data[di.key] = c.lru.PushFront(di)
+    c.size += di.size
+    c.tags.add(di.key, di.header.Tags)
+}
+
+// evict least recently used files until the cache fits,
+// must be called with the lock held
+func (c *DiskCache) makeRoom(keep *diskItem) {
+    for c.size > c.MaxSize {
+        e := c.lru.Back()
+        if e == nil || e.Value.(*diskItem) == keep {
+            return
+        }
+        c.remove(e)
+        c.stats.Evictions++
+    }
+}
+
+// drop an item from the index and delete its file,
+// must be called with the lock held
+func (c *DiskCache) remove(e *list.Element) {
+    di := e.Value.(*diskItem)
+    c.lru.Remove(e)
+    delete(c.data, di.key)
+    c.size -= di.size
+    c.tags.remove(di.key, di.header.Tags)
+    if err := os.Remove(di.file); err != nil && !os.IsNotExist(err) {
+        log.Println(err)
+    }
+}
+
+// Remove an item or, with soft, add a copy of it to expire, for its
+// file to be rewritten once the lock is released. Must be called
+// with the lock held.
+func (c *DiskCache) purge(e *list.Element, soft bool, expire []diskItem) []diskItem {
+    if !soft {
+        c.remove(e)
+        return expire
+    }
+    if di := e.Value.(*diskItem); !di.header.entry().expired() {
+        expire = append(expire, *di)
+    }
+    return expire
+}
+
+// rewrite the files of soft purged items to expire now
+func (c *DiskCache) expire(items []diskItem) {
+    t := time.Now()
+    for _, di := range items {
+        err := c.setExpires(di, t)
+        if err != nil && err != errDiskItemChanged {
+            log.Println("Error expiring cache file, removing it:", err)
+            c.deleteItem(&di)
+        }
+    }
+}
+
+// Rewrite the file of an item, as copied under the lock, with a new
+// expiry time. The file is read and written without the lock, then
+// renamed into place with it held unless the item has been replaced
+// in the meantime, in which case the newer file is left alone.
+func (c *DiskCache) setExpires(old diskItem, t time.Time) error {
+    di := old
+    di.header.Expires = t.Unix()
+    _, b, err := readDiskResponse(di.file)
+    if err != nil {
+        return err
+    }
+    tmp, err := writeDiskItem(&di, b)
+    if err != nil {
+        return err
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    e, ok := c.data[di.key]
+    if !ok || e.Value.(*diskItem).gen != old.gen {
+        os.Remove(tmp)
+        return errDiskItemChanged
+    }
+    if err = os.Rename(tmp, di.file); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    // Get reads items once unlocked, so they're replaced rather than changed
+    cur := e.Value.(*diskItem)
+    di.hits = cur.hits
+    c.size += di.size - cur.size
+    c.gen++
+    di.gen = c.gen
+    e.Value = &di
+    return nil
+}
+
+// write an item's header followed by its response to a temporary file
+func writeDiskItem(di *diskItem, response []byte) (string, error) {
+    line, err := json.Marshal(di.header)
+    if err != nil {
+        return "", err
+    }
+    line = append(line, '\n')
+    di.size = int64(len(line) + len(response))
+    return writeDiskTmp(di.file, line, response)
+}
+
+// remove an item unless its file was replaced since it was looked up
+func (c *DiskCache) deleteItem(di *diskItem) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if e, ok := c.data[di.key]; ok && e.Value.(*diskItem).gen == di.gen {
+        c.remove(e)
+    }
+}
+
+func (c *DiskCache) Delete(key string) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    e, ok := c.data[key]
+    if ok {
+        c.remove(e)
+    }
+    return ok
+}
+
+func (c *DiskCache) PurgePrefix(prefix string) int {
+    return c.PurgeMatch(func(key string, e *Entry) bool {
+        return strings.HasPrefix(key, prefix)
+    }, false)
+}
+
+func (c *DiskCache) PurgeTags(tags []string, soft bool) int {
+    c.lock.Lock()
+    n := 0
+    var expire []diskItem
+    for _, key := range c.tags.lookup(tags) {
+        if e, ok := c.data[key]; ok {
+            expire = c.purge(e, soft, expire)
+            n++
+        }
+    }
+    c.lock.Unlock()
+    c.expire(expire)
+    return n
+}
+
+// match is given the entry without its response, which stays on disk
+func (c *DiskCache) PurgeMatch(match func(key string, e *Entry) bool, soft bool) int {
+    c.lock.Lock()
+    n := 0
+    var expire []diskItem
+    for k, e := range c.data {
+        if match(k, e.Value.(*diskItem).header.entry()) {
+            expire = c.purge(e, soft, expire)
+            n++
+        }
+    }
+    c.lock.Unlock()
+    c.expire(expire)
+    return n
+}
+
+func (c *DiskCache) Peek(key string) (*Entry, int64) {
+    c.lock.Lock()
+    e, ok := c.data[key]
+    if !ok {
+        c.lock.Unlock()
+        return nil, 0
+    }
+    di := e.Value.(*diskItem)
+    hits := di.hits
+    c.lock.Unlock()
+
+    h, b, err := readDiskResponse(di.file)
+    if err != nil {
+        return nil, 0
+    }
+    entry := h.entry()
+    entry.Response = b
+    return entry, hits
+}
+
+func (c *DiskCache) Keys(match func(key string) bool, limit int) []string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    keys := make([]string, 0)
+    for k := range c.data {
+        if limit > 0 && len(keys) >= limit {
+            break
+        }
+        if match(k) {
+            keys = append(keys, k)
+        }
+    }
+    return keys
+}
+
+func (c *DiskCache) SetExpires(key string, t time.Time) bool {
+    c.lock.Lock()
+    e, ok := c.data[key]
+    var di diskItem
+    if ok {
+        di = *e.Value.(*diskItem)
+    }
+    c.lock.Unlock()
+    if !ok {
+        return false
+    }
+    if err := c.setExpires(di, t); err != nil {
+        log.Println("Error updating cache file:", err)
+        return false
+    }
+    return true
+}
+
+func (c *DiskCache) PurgeExpired() {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    t := time.Now()
+    for _, e := range c.data {
+        if e.Value.(*diskItem).header.entry().staleUntil().Before(t) {
+            c.remove(e)
+            c.stats.Expired++
+        }
+    }
+}
+
+func (c *DiskCache) Stats() CacheStats {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    s := c.stats
+    s.Entries = int64(len(c.data))
+    s.Bytes = c.size
+    return s
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "sync/atomic"
+)
+
+// health check defaults, times in seconds
+const (
+    defaultCheckInterval    = 10
+    defaultCheckTimeout     = 5
+    defaultCheckStatus      = 200
+    defaultCheckRise        = 2
+    defaultCheckFall        = 3
+)
+
+// passive ejection defaults, fail timeout in seconds
+const (
+    defaultMaxFails     = 3
+    defaultFailTimeout  = 10
+)
+
+// states of an origin as shown by origins status
+const (
+    originUp        = "up"
+    originDown      = "down"        // failed its active checks
+    originEjected   = "ejected"     // failed requests, until the fail timeout
+    originDrained   = "drained"     // taken out by hand
+)
+
+// Active health check of a location's origins. Path is requested
+// on each origin every Interval seconds, an origin goes down after
+// Fall checks in a row fail and back up after Rise in a row pass.
+type HealthCheckConfig struct {
+    Path            string      `json:"path"`
+    Interval        int         `json:"interval"`
+    Timeout         int         `json:"timeout"`
+    ExpectedStatus  int         `json:"expected_status"`
+    Rise            int         `json:"rise"`
+    Fall            int         `json:"fall"`
+}
+
+// check the config and fill in defaults
+func (hc *HealthCheckConfig) validate() error {
+    if hc.Path == "" {
+        hc.Path = "/"
+    }
+    if !strings.HasPrefix(hc.Path, "/") {
+        return errors.New("health check path must start with / " + hc.Path)
+    }
+    if hc.Interval <= 0 {
+        hc.Interval = defaultCheckInterval
+    }
+    if hc.Timeout <= 0 {
+        hc.Timeout = defaultCheckTimeout
+    }
+    if hc.ExpectedStatus == 0 {
+        hc.ExpectedStatus = defaultCheckStatus
+    }
+    if hc.Rise <= 0 {
+        hc.Rise = defaultCheckRise
+    }
+    if hc.Fall <= 0 {
+        hc.Fall = defaultCheckFall
+    }
+    return nil
+}
+
+// health of an origin, from checks, failed requests and the admin
+type originHealth struct {
+    lock            sync.Mutex
+    down            bool
+    drained         bool
+    passes          int     // active checks passed in a row
+    fails           int     // active checks failed in a row
+    requestFails    int     // requests failed in a row
+    ejectedUntil    time.Time
+    lastErr         string
+}
+
+// whether requests may be sent to the origin
+func (o *Origin) available() bool {
+    return o.state() == originUp && !o.breaker.blocking()
+}
+
+func (o *Origin) state() string {
+    h := &o.health
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    switch {
+    case h.drained:
+        return originDrained
+    case h.down:
+        return originDown
+    case time.Now().Before(h.ejectedUntil):
+        return originEjected
+    }
+    return originUp
+}
+
+// A request to the origin failed to connect or got a 5xx. After
+// maxFails in a row the origin is ejected for the fail timeout.
+func (p *OriginPool) failed(o *Origin, reason string) {
+    h := &o.health
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    h.lastErr = reason
+    h.requestFails++
+    if h.requestFails >= p.maxFails {
+        h.requestFails = 0
+        h.ejectedUntil = time.Now().Add(p.failTimeout)
+        log.Println("Ejecting origin", o.URL.String(), "for", p.failTimeout.String() + ":", reason)
+    }
+}
+
+func (p *OriginPool) succeeded(o *Origin) {
+    h := &o.health
+    h.lock.Lock()
+    h.requestFails = 0
+    h.lock.Unlock()
+}
+
+// start checking the pool's origins, if it has a health check
+func (p *OriginPool) startHealthChecks() {
+    if p.check == nil {
+        return
+    }
+    p.checks.Do(func() {
+        go p.runHealthChecks()
+    })
+}
+
+func (p *OriginPool) runHealthChecks() {
+    client := &http.Client{
+        Transport: p.transport,
+        Timeout: time.Duration(p.check.Timeout) * time.Second,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    ticker := time.NewTicker(time.Duration(p.check.Interval) * time.Second)
+    for {
+        var wg sync.WaitGroup
+        for _, o := range p.Origins {
+            wg.Add(1)
+            go func(o *Origin) {
+                defer wg.Done()
+                p.checkOrigin(client, o)
+            }(o)
+        }
+        wg.Wait()
+        <-ticker.C
+    }
+}
+
+// request the check path and apply the rise and fall thresholds
+func (p *OriginPool) checkOrigin(client *http.Client, o *Origin) {
+    ref, _ := url.Parse(p.check.Path)
+    var reason string
+    resp, err := client.Get(o.URL.ResolveReference(ref).String())
+    if err != nil {
+        reason = err.Error()
+    } else {
+        resp.Body.Close()
+        if resp.StatusCode != p.check.ExpectedStatus {
+            reason = "health check returned " + resp.Status
+        }
+    }
+
+    h := &o.health
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    if reason == "" {
+        h.fails = 0
+        h.passes++
+        if h.down && h.passes >= p.check.Rise {
+            h.down = false
+            log.Println("Origin", o.URL.String(), "is up")
+        }
+        return
+    }
+    h.lastErr = reason
+    h.passes = 0
+    h.fails++
+    if !h.down && h.fails >= p.check.Fall {
+        h.down = true
+        log.Println("Origin", o.URL.String(), "is down:", reason)
+    }
+}
+
+// admin commands for the origins behind each location
+func registerOriginCommands() {
+    cmds["origins"] = &Command{
+        "origins",
+        "Show or change the state of origins: origins status|drain|enable ...",
+        []string{},
+        map[string]*Command{
+            "status": subcommand("origins", "status", "", 0, func(args []string) (string, error) {
+                return originStatus(), nil
+            }),
+            "drain": subcommand("origins", "drain", "<url>", 1, func(args []string) (string, error) {
+                n := setDrained(args[0], true)
+                if n == 0 {
+                    return "", errors.New("Origin not found.")
+                }
+                return "Drained " + args[0] + " in " + strconv.Itoa(n) + " locations.", nil
+            }),
+            "enable": subcommand("origins", "enable", "<url>", 1, func(args []string) (string, error) {
+                n := setDrained(args[0], false)
+                if n == 0 {
+                    return "", errors.New("Origin not found.")
+                }
+                return "Enabled " + args[0] + " in " + strconv.Itoa(n) + " locations.", nil
+            }),
+        },
+        func(context []string) (reply string, err error) {
+            return runSubcommand("origins", context)
+        },
+    }
+}
+
+// pools of every location, each vhost listed once, sorted by name
+func locationPools() (names []string, pools map[string]*OriginPool) {
+    pools = make(map[string]*OriginPool)
+    for v, cfg := range vHosts {
+        if cfg.VHosts[0] != v {
+            continue
+        }
+        for loc, lc := range cfg.Location {
+            if lc.Pool != nil {
+                names = append(names, v + loc)
+                pools[v + loc] = lc.Pool
+            }
+        }
+    }
+    sort.Strings(names)
+    return names, pools
+}
+
+func originStatus() string {
+    names, pools := locationPools()
+    var lines []string
+    for _, name := range names {
+        lines = append(lines, name + " (" + pools[name].Policy + ")")
+        for _, o := range pools[name].Origins {
+            o.health.lock.Lock()
+            lastErr := o.health.lastErr
+            o.health.lock.Unlock()
+            line := "  " + o.URL.String() + " " + o.state() +
+                " weight=" + strconv.Itoa(o.Weight) +
+                " active=" + strconv.FormatInt(atomic.LoadInt64(&o.active), 10)
+            if o.breaker != nil {
+                line += " breaker=" + o.breaker.status()
+            }
+            if lastErr != "" {
+                line += " last_error=\"" + lastErr + "\""
+            }
+            lines = append(lines, line)
+        }
+    }
+    if len(lines) == 0 {
+        return "No origins configured."
+    }
+    return strings.Join(lines, "\r\n")
+}
+
+// Drain or enable an origin in every location it serves. Enabling
+// also clears an ejection, a failed health check and an open
+// breaker, which will take the origin out again if it is still
+// failing.
+func setDrained(rawurl string, drained bool) int {
+    want := strings.TrimSuffix(rawurl, "/")
+    _, pools := locationPools()
+    n := 0
+    for _, p := range pools {
+        for _, o := range p.Origins {
+            if strings.TrimSuffix(o.URL.String(), "/") != want {
+                continue
+            }
+            h := &o.health
+            h.lock.Lock()
+            h.drained = drained
+            if !drained {
+                h.down = false
+                h.fails, h.passes, h.requestFails = 0, 0, 0
+                h.ejectedUntil = time.Time{}
+            }
+            h.lock.Unlock()
+            if !drained {
+                o.breaker.close("enabled by hand")
+            }
+            n++
+        }
+    }
+    return n
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+    "fmt"
+    "sort"
+    "time"
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// number of keys listed by cache keys when no limit is given
+const defaultKeysLimit = 100
+
+// admin commands for looking at what the cache holds
+func registerCacheCommands() {
+    cmds["cache"] = &Command{
+        "cache",
+        "Inspect the cache: cache stats|keys|show|ttl ...",
+        []string{},
+        map[string]*Command{
+            "stats": subcommand("cache", "stats", "", 0, withCache(func(args []string) (string, error) {
+                st := cache.Stats()
+                return fmt.Sprintf("Entries: %d\r\nBytes: %d\r\nHits: %d\r\nMisses: %d\r\n" +
+                    "Hit ratio: %.2f%%\r\nEvictions: %d\r\nExpired: %d\r\nRejected: %d",
+                    st.Entries, st.Bytes, st.Hits, st.Misses, st.HitRatio() * 100,
+                    st.Evictions, st.Expired, st.Rejected), nil
+            })),
+            "keys": subcommand("cache", "keys", "[regex] [limit]", 0, withCache(func(args []string) (string, error) {
+                re := regexp.MustCompile("")
+                limit := defaultKeysLimit
+                var err error
+                if len(args) > 0 {
+                    if re, err = regexp.Compile(args[0]); err != nil {
+                        return "", err
+                    }
+                }
+                if len(args) > 1 {
+                    if limit, err = strconv.Atoi(args[1]); err != nil {
+                        return "", errors.New("Invalid limit " + args[1] + ".")
+                    }
+                }
+                keys := cache.Keys(re.MatchString, limit)
+                sort.Strings(keys)
+                return strings.Join(keys, "\r\n"), nil
+            })),
+            "show": subcommand("cache", "show", "<key>", 1, withCache(func(args []string) (string, error) {
+                key := strings.Join(args, " ")
+                e, hits := cache.Peek(key)
+                if e == nil {
+                    return "", errors.New("Key not found.")
+                }
+                return showEntry(key, e, hits), nil
+            })),
+            "ttl": subcommand("cache", "ttl", "<key> <seconds>", 2, withCache(func(args []string) (string, error) {
+                // the key may contain spaces, the seconds come last
+                seconds, err := strconv.Atoi(args[len(args) - 1])
+                if err != nil {
+                    return "", errors.New("Invalid number of seconds " + args[len(args) - 1] + ".")
+                }
+                key := strings.Join(args[:len(args) - 1], " ")
+                if !cache.SetExpires(key, time.Now().Add(time.Duration(seconds) * time.Second)) {
+                    return "", errors.New("Key not found.")
+                }
+                return "TTL of " + key + " set to " + strconv.Itoa(seconds) + "s.", nil
+            })),
+        },
+        func(context []string) (reply string, err error) {
+            return runSubcommand("cache", context)
+        },
+    }
+}
+
+// describe an entry for cache show, followed by its response headers
+func showEntry(key string, e *Entry, hits int64) string {
+    lines := []string{
+        "Key: " + key,
+        "Host: " + e.Host,
+        "URL: " + e.URL,
+        "Expires: " + e.Expires.Format(time.RFC1123),
+        "TTL: " + strconv.Itoa(int(time.Until(e.Expires).Seconds())) + "s",
+        "Stale-While-Revalidate: " + e.StaleWhileRevalidate.String(),
+        "Stale-If-Error: " + e.StaleIfError.String(),
+        "Size: " + strconv.Itoa(len(e.Response)),
+        "Hits: " + strconv.FormatInt(hits, 10),
+        "Tags: " + strings.Join(e.originTags(), " "),
+    }
+    if names, ok := parseVaryMarker(e.Response); ok {
+        lines = append(lines, "Vary: " + strings.Join(names, ", "))
+        return strings.Join(lines, "\r\n")
+    }
+
+    resp, err := readCachedResponse(e.Response, nil)
+    if err != nil {
+        lines = append(lines, "Unreadable response: " + err.Error())
+        return strings.Join(lines, "\r\n")
+    }
+    resp.Body.Close()
+    lines = append(lines, "", resp.Proto + " " + resp.Status)
+    names := make([]string, 0, len(resp.Header))
+    for name := range resp.Header {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        for _, v := range resp.Header[name] {
+            lines = append(lines, name + ": " + v)
+        }
+    }
+    return strings.Join(lines, "\r\n")
+}
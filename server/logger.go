@@ -23,6 +23,7 @@ type AccessLog struct {
     ContentLength   int64
     RequestTime     time.Duration
     OriginTime      time.Duration
+    Attempts        int
     Timestamp       time.Time
     CacheStatus     string
     Referer         string
@@ -65,6 +66,14 @@ func (l *AccessLog) ParseResp(resp *http.Response) {
     l.URL           = resp.Request.URL
 }
 
+// Copy values to the log for an error response, made when
+// there was no response to pass on
+func (l *AccessLog) ParseError(code int) {
+    l.Status        = strconv.Itoa(code) + " " + http.StatusText(code)
+    l.StatusCode    = code
+    l.RequestTime   = time.Since(l.Timestamp)
+}
+
 func openAccessLogs() {
     accessLogger = make([]*AccessLogger, 0)
     for _, l := range config.Logs {
@@ -93,6 +102,7 @@ func (l *AccessLog) Log() {
             "$http_host", l.Host,
             "$request_method", l.Method,
             "$origin_response_time", l.OriginTime.String(),
+            "$upstream_attempts", strconv.Itoa(l.Attempts),
             "$server_protocol", l.Proto,
             "$zone_query_string", l.URL.RawQuery,
             "$http_referer", l.Referer,
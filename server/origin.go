@@ -0,0 +1,286 @@
+package server
+
+import (
+    "io"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "strconv"
+    "net/url"
+    "net/http"
+    "crypto/md5"
+    "sync/atomic"
+    "encoding/binary"
+    "net/http/httputil"
+)
+
+// how a location spreads requests over its origins
+const (
+    BalanceRoundRobin   = "round_robin"     // each origin in turn
+    BalanceWeighted     = "weighted"        // in turn, in proportion to weight
+    BalanceLeastConn    = "least_conn"      // fewest open requests for its weight
+    BalanceHash         = "hash"            // consistent hash on the cache key
+)
+
+// points on the hash ring for each unit of weight
+const hashReplicas = 160
+
+var errNoOrigin = errors.New("every origin is drained")
+
+// An origin as configured in a location's origins list
+type OriginConfig struct {
+    URL         string      `json:"url"`
+    Weight      int         `json:"weight"`
+}
+
+// An origin server requests can be sent to
+type Origin struct {
+    URL         *url.URL
+    Weight      int
+    proxy       *httputil.ReverseProxy
+    active      int64   // requests sent whose bodies are still open
+    current     int     // for the weighted policy, under the pool lock
+    health      originHealth
+    breaker     *circuitBreaker
+}
+
+// The origins of a location and the policy choosing between them.
+// Origins that are down are skipped unless all of them are.
+// Drained origins are always skipped.
+type OriginPool struct {
+    Origins     []*Origin
+    Policy      string
+    lock        sync.Mutex
+    next        uint32
+    ring        []ringPoint
+    check       *HealthCheckConfig
+    maxFails    int
+    failTimeout time.Duration
+    checks      sync.Once
+    retries     *retryBudget
+    transport   *http.Transport
+}
+
+type ringPoint struct {
+    hash        uint32
+    origin      *Origin
+}
+
+// The pool of a location's origins, where a single origin
+// is a pool of one
+func newOriginPool(lc *LocationConfig) (*OriginPool, error) {
+    origins := lc.Origins
+    if len(origins) == 0 {
+        origins = []OriginConfig{{URL: lc.Origin, Weight: 1}}
+    }
+    policy := lc.Balance
+    switch policy {
+    case "":
+        policy = BalanceRoundRobin
+    case BalanceRoundRobin, BalanceWeighted, BalanceLeastConn, BalanceHash:
+    default:
+        return nil, errors.New("unknown balance policy " + policy)
+    }
+
+    p := &OriginPool{
+        Policy: policy,
+        check: lc.HealthCheck,
+        maxFails: lc.MaxFails,
+        failTimeout: time.Duration(lc.FailTimeout) * time.Second,
+        retries: newRetryBudget(lc.RetryBudget, lc.RetryBudgetMin),
+        transport: lc.newTransport(),
+    }
+    if p.maxFails <= 0 {
+        p.maxFails = defaultMaxFails
+    }
+    if p.failTimeout <= 0 {
+        p.failTimeout = defaultFailTimeout * time.Second
+    }
+    if p.check != nil {
+        if err := p.check.validate(); err != nil {
+            return nil, err
+        }
+    }
+    if lc.CircuitBreaker != nil {
+        if err := lc.CircuitBreaker.validate(); err != nil {
+            return nil, err
+        }
+    }
+    for _, oc := range origins {
+        u, err := url.Parse(oc.URL)
+        if err != nil {
+            return nil, err
+        }
+        if u.Scheme == "" || u.Host == "" {
+            return nil, errors.New("invalid origin " + oc.URL)
+        }
+        o := &Origin{
+            URL: u,
+            Weight: oc.Weight,
+            proxy: httputil.NewSingleHostReverseProxy(u),
+            breaker: newCircuitBreaker(lc.CircuitBreaker, u.String()),
+        }
+        if o.Weight <= 0 {
+            o.Weight = 1
+        }
+        p.Origins = append(p.Origins, o)
+    }
+    if policy == BalanceHash {
+        p.buildRing()
+    }
+    return p, nil
+}
+
+// Place each origin on the ring in proportion to its weight, so
+// adding or removing one only moves the keys next to its points
+func (p *OriginPool) buildRing() {
+    for _, o := range p.Origins {
+        for i := 0; i < o.Weight * hashReplicas; i++ {
+            h := ringHash(o.URL.String() + "#" + strconv.Itoa(i))
+            p.ring = append(p.ring, ringPoint{h, o})
+        }
+    }
+    sort.Slice(p.ring, func(i, j int) bool {
+        return p.ring[i].hash < p.ring[j].hash
+    })
+}
+
+// Choose the origin for a request, key is only used by the hash
+// policy. Origins already tried for the request are passed over,
+// as are origins that are down. When every origin left is down
+// they are tried regardless, rather than failing requests one of
+// them might still answer. Drained origins are never picked, nil
+// is returned when they are all there is.
+func (p *OriginPool) pick(key string, tried []*Origin) *Origin {
+    serving := func(o *Origin) bool {
+        return o.state() != originDrained
+    }
+    if len(p.Origins) == 1 {
+        if serving(p.Origins[0]) {
+            return p.Origins[0]
+        }
+        return nil
+    }
+    untried := func(o *Origin) bool {
+        for _, t := range tried {
+            if t == o {
+                return false
+            }
+        }
+        return serving(o)
+    }
+    ok := func(o *Origin) bool {
+        return untried(o) && o.available()
+    }
+    if !p.any(ok) {
+        ok = untried
+        if !p.any(ok) {
+            ok = serving
+            if !p.any(ok) {
+                return nil
+            }
+        }
+    }
+    switch p.Policy {
+    case BalanceWeighted:
+        return p.pickWeighted(ok)
+    case BalanceLeastConn:
+        return p.pickLeastConn(ok)
+    case BalanceHash:
+        return p.pickHash(key, ok)
+    }
+    n := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.Origins)))
+    for i := range p.Origins {
+        if o := p.Origins[(n + i) % len(p.Origins)]; ok(o) {
+            return o
+        }
+    }
+    return nil
+}
+
+func (p *OriginPool) any(ok func(*Origin) bool) bool {
+    for _, o := range p.Origins {
+        if ok(o) {
+            return true
+        }
+    }
+    return false
+}
+
+// smooth weighted round robin, as in nginx, which
+// interleaves origins rather than sending runs to each
+func (p *OriginPool) pickWeighted(ok func(*Origin) bool) *Origin {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    var best *Origin
+    total := 0
+    for _, o := range p.Origins {
+        if !ok(o) {
+            continue
+        }
+        o.current += o.Weight
+        total += o.Weight
+        if best == nil || o.current > best.current {
+            best = o
+        }
+    }
+    best.current -= total
+    return best
+}
+
+// fewest open requests relative to weight, starting from
+// a different origin each time so ties are spread out
+func (p *OriginPool) pickLeastConn(ok func(*Origin) bool) *Origin {
+    start := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.Origins)))
+    var best *Origin
+    var bestActive int64
+    for i := range p.Origins {
+        o := p.Origins[(start + i) % len(p.Origins)]
+        if !ok(o) {
+            continue
+        }
+        active := atomic.LoadInt64(&o.active)
+        if best == nil || active * int64(best.Weight) < bestActive * int64(o.Weight) {
+            best, bestActive = o, active
+        }
+    }
+    return best
+}
+
+// position on the hash ring, from the start of an md5 sum as
+// crc32 places similar strings, such as the points of an origin,
+// too close together
+func ringHash(s string) uint32 {
+    sum := md5.Sum([]byte(s))
+    return binary.BigEndian.Uint32(sum[:4])
+}
+
+// the first origin clockwise from the key's point on the ring,
+// so keys of an origin that is down are spread over the rest
+func (p *OriginPool) pickHash(key string, ok func(*Origin) bool) *Origin {
+    h := ringHash(key)
+    i := sort.Search(len(p.ring), func(i int) bool {
+        return p.ring[i].hash >= h
+    })
+    for n := 0; n < len(p.ring); n++ {
+        if o := p.ring[(i + n) % len(p.ring)].origin; ok(o) {
+            return o
+        }
+    }
+    return nil
+}
+
+// Response body counting as an open request to its origin until closed
+type originBody struct {
+    io.ReadCloser
+    origin      *Origin
+    closed      int32
+}
+
+func (b *originBody) Close() error {
+    if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+        atomic.AddInt64(&b.origin.active, -1)
+    }
+    return b.ReadCloser.Close()
+}
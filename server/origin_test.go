@@ -0,0 +1,153 @@
+package server
+
+import (
+	"time"
+	"context"
+	"strconv"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OriginPool", func() {
+
+	// a pool of origins at the given urls and weights
+	newPool := func(policy string, urls []string, weights ...int) *OriginPool {
+		lc := &LocationConfig{Balance: policy}
+		for i, w := range weights {
+			lc.Origins = append(lc.Origins, OriginConfig{URL: urls[i], Weight: w})
+		}
+		p, err := newOriginPool(lc)
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+	hosts := []string{"http://o0.test", "http://o1.test", "http://o2.test"}
+
+	index := func(p *OriginPool, o *Origin) int {
+		for i := range p.Origins {
+			if p.Origins[i] == o {
+				return i
+			}
+		}
+		return -1
+	}
+
+	It("spreads requests by policy and weight", func() {
+		for _, c := range []struct {
+			policy  string
+			weights []int
+			want    []int
+			margin  int
+		}{
+			{BalanceRoundRobin, []int{1, 3}, []int{2000, 2000}, 0},
+			{BalanceWeighted, []int{1, 3}, []int{1000, 3000}, 0},
+			{BalanceWeighted, []int{2, 1, 1}, []int{2000, 1000, 1000}, 0},
+			{BalanceLeastConn, []int{1, 1, 2}, []int{1333, 1333, 1333}, 1},
+			{BalanceHash, []int{1, 3}, []int{1000, 3000}, 150},
+			{BalanceHash, []int{1, 1, 1}, []int{1333, 1333, 1333}, 150},
+		} {
+			p := newPool(c.policy, hosts, c.weights...)
+			counts := make([]int, len(c.weights))
+			for i := 0; i < 4000; i++ {
+				counts[index(p, p.pick("GET /" + strconv.Itoa(i), nil))]++
+			}
+			for i := range counts {
+				Expect(counts[i]).To(BeNumerically("~", c.want[i], c.margin), c.policy + " " + strconv.Itoa(i))
+			}
+		}
+	})
+
+	It("passes over origins already tried", func() {
+		for _, policy := range []string{BalanceRoundRobin, BalanceWeighted, BalanceLeastConn, BalanceHash} {
+			p := newPool(policy, hosts, 1, 2, 1)
+			first := p.pick("key", nil)
+			second := p.pick("key", []*Origin{first})
+			Expect(second).NotTo(BeNil())
+			Expect(second).NotTo(Equal(first), policy)
+			third := p.pick("key", []*Origin{first, second})
+			Expect(third).NotTo(Equal(first), policy)
+			Expect(third).NotTo(Equal(second), policy)
+		}
+	})
+
+	It("keeps keys on the same origin", func() {
+		p := newPool(BalanceHash, hosts, 1, 1, 1)
+		picked := make(map[string]*Origin)
+		for i := 0; i < 1000; i++ {
+			key := "GET /" + strconv.Itoa(i)
+			picked[key] = p.pick(key, nil)
+		}
+		for key, o := range picked {
+			Expect(p.pick(key, nil)).To(Equal(o))
+		}
+
+		// with an origin passed over, only its keys move
+		skip := p.Origins[0]
+		moved := 0
+		for key, o := range picked {
+			again := p.pick(key, []*Origin{skip})
+			if o == skip {
+				Expect(again).NotTo(Equal(skip))
+				moved++
+			} else {
+				Expect(again).To(Equal(o))
+			}
+		}
+		Expect(moved).To(BeNumerically(">", 0))
+	})
+
+	It("picks the origin with the fewest open requests for its weight", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer origin.Close()
+		// both origins are the same server under different names
+		urls := []string{origin.URL, "http://localhost:" + origin.URL[len("http://127.0.0.1:"):]}
+		p := newPool(BalanceLeastConn, urls, 1, 2)
+
+		for _, c := range []struct {
+			open    []int
+			want    int
+		}{
+			{[]int{1, 0}, 1},
+			{[]int{1, 1}, 1},
+			{[]int{1, 3}, 0},
+			{[]int{2, 3}, 1},
+			{[]int{0, 1}, 0},
+		} {
+			var bodies []*http.Response
+			for i, n := range c.open {
+				for j := 0; j < n; j++ {
+					req, _ := http.NewRequest("GET", "/", nil)
+					resp, err := roundTrip(p.transport, p, p.Origins[i], req)
+					Expect(err).NotTo(HaveOccurred())
+					bodies = append(bodies, resp)
+				}
+			}
+			for i := 0; i < 10; i++ {
+				Expect(index(p, p.pick("", nil))).To(Equal(c.want), strconv.Itoa(c.open[0]) + "," + strconv.Itoa(c.open[1]))
+			}
+			for _, resp := range bodies {
+				resp.Body.Close()
+			}
+		}
+	})
+
+	It("doesn't count requests the client gave up on against the origin", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer origin.Close()
+		lc := &LocationConfig{Origin: origin.URL, MaxFails: 1}
+		p, err := newOriginPool(lc)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+			req, _ := http.NewRequest("GET", "/", nil)
+			_, err := roundTrip(p.transport, p, p.Origins[0], req.WithContext(ctx))
+			cancel()
+			Expect(err).To(HaveOccurred())
+		}
+		Expect(p.Origins[0].state()).To(Equal(originUp))
+	})
+})
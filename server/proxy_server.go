@@ -1,18 +1,16 @@
 package server
 
 import(
-    "io"
     "log"
     "net"
     "sync"
     "time"
-    "bufio"
-    "bytes"
-    "net/url"
+    "errors"
+    "context"
     "strconv"
     "strings"
     "net/http"
-    "net/http/httputil"
+    "sync/atomic"
 )
 
 // Wrapper for http.Handler interface, used to implement serveHTTP()
@@ -21,17 +19,6 @@ type proxyHandler struct {
     Config      *LocationConfig
 }
 
-type Target struct {
-    Active  bool
-    Waiting int
-    Chan    chan []byte
-}
-
-type ActiveRequests struct{
-    Lock    sync.Mutex
-    Targets map[string]*Target
-}
-
 // Hop-by-hop headers. These are removed when sent to the backend.
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
@@ -45,36 +32,6 @@ var hopHeaders = []string{
     "Upgrade",
 }
 
-func (ar *ActiveRequests) Start(target string) bool {
-    ar.Lock.Lock()
-    defer ar.Lock.Unlock()
-    if _, ok := ar.Targets[target]; !ok {
-        ar.Targets[target] = &Target{
-            Chan: make(chan []byte),
-        }
-    }
-    if !ar.Targets[target].Active {
-        ar.Targets[target].Active = true
-        return true
-    }
-    ar.Targets[target].Waiting++
-    return false
-}
-
-func (ar *ActiveRequests) Stop(target string, b []byte) {
-    ar.Lock.Lock()
-    defer ar.Lock.Unlock()
-    ar.Targets[target].Active = false
-    for i := 0; i < ar.Targets[target].Waiting; i++ {
-        ar.Targets[target].Chan <- b
-    }
-}
-
-func (ar *ActiveRequests) Wait(target string) []byte {
-    b := <- ar.Targets[target].Chan
-    return b
-}
-
 func copyHeader(dst, src http.Header) {
     for k, vv := range src {
         for _, v := range vv {
@@ -83,11 +40,12 @@ func copyHeader(dst, src http.Header) {
     }
 }
 
-// send response to the client
+// send response to the client, flushing as it goes since
+// the body may still be arriving from a collapsed request
 func respond(res *http.Response, rw http.ResponseWriter) {
     copyHeader(rw.Header(), res.Header)
     rw.WriteHeader(res.StatusCode)
-    io.Copy(rw, res.Body)
+    copyBody(rw, nil, res.Body, false, 0)
 }
 
 func headerControl(lc *LocationConfig, resp *http.Response) {
@@ -99,15 +57,20 @@ func headerControl(lc *LocationConfig, resp *http.Response) {
     }
 }
 
-func proxy(lc *LocationConfig, req  *http.Request) (*http.Response, error) {
-    transport := lc.Proxy.Transport
-    if transport == nil {
-        transport = http.DefaultTransport
+// Send a request to an origin of the location. Idempotent requests
+// that fail are retried on the next origin, up to lc.Retries times
+// while the retry budget lasts, and origins with an open breaker are
+// passed over. attempts is the number of origin requests made.
+func proxy(lc *LocationConfig, req  *http.Request) (resp *http.Response, attempts int, err error) {
+    transport := lc.Pool.transport
+
+    key := ""
+    if lc.Pool.Policy == BalanceHash {
+        key = lc.GetCacheKey(req)
     }
 
     outreq := new(http.Request)
     *outreq = *req // includes shallow copies of maps, but okay
-    lc.Proxy.Director(outreq)    
     outreq.Proto = "HTTP/1.1"
     outreq.ProtoMajor = 1
     outreq.ProtoMinor = 1
@@ -139,10 +102,38 @@ func proxy(lc *LocationConfig, req  *http.Request) (*http.Response, error) {
         }
         outreq.Header.Set("X-Forwarded-For", clientIP)
     }
-    resp, err := transport.RoundTrip(outreq)
+    retry := lc.retryable(req)
+    lc.Pool.retries.request()
+    var tried []*Origin
+    for {
+        origin := lc.Pool.pick(key, tried)
+        if origin == nil {
+            err = errNoOrigin
+            break
+        }
+        tried = append(tried, origin)
+        resp, err = roundTrip(transport, lc.Pool, origin, outreq)
+        if err == errCircuitOpen {
+            // nothing was sent, so the next origin is tried straight away
+            if len(tried) < len(lc.Pool.Origins) {
+                continue
+            }
+            break
+        }
+        attempts++
+        if !retry || attempts > lc.Retries || !lc.retryOn(resp, err) || !lc.Pool.retries.withdraw() {
+            break
+        }
+        if resp != nil {
+            resp.Body.Close()
+        }
+        if !lc.backoff(req, attempts) {
+            // the response was given up on, so there's only the error
+            return nil, attempts, req.Context().Err()
+        }
+    }
     if err != nil {
-        log.Println("http: proxy error: %v", err)
-        return resp, err
+        return nil, attempts, err
     }
 
     for _, h := range hopHeaders {
@@ -151,7 +142,72 @@ func proxy(lc *LocationConfig, req  *http.Request) (*http.Response, error) {
 
     headerControl(lc, resp)
 
-    return resp, err
+    return resp, attempts, nil
+}
+
+// Make one attempt of a request on origin, reporting the outcome
+// to the pool and the origin's breaker, which may refuse to let it
+// through. The URL is copied as the director rewrites it.
+func roundTrip(transport http.RoundTripper, pool *OriginPool, origin *Origin, req *http.Request) (*http.Response, error) {
+    outreq := new(http.Request)
+    *outreq = *req
+    u := *req.URL
+    outreq.URL = &u
+    origin.proxy.Director(outreq)
+
+    if !origin.breaker.allow() {
+        return nil, errCircuitOpen
+    }
+    atomic.AddInt64(&origin.active, 1)
+    start := time.Now()
+    resp, err := transport.RoundTrip(outreq)
+    // the client going away says nothing about the origin
+    cancelled := err != nil && req.Context().Err() != nil
+    if cancelled {
+        origin.breaker.cancel()
+    } else {
+        origin.breaker.record(err != nil || resp.StatusCode >= 500, time.Since(start))
+    }
+    if err != nil {
+        atomic.AddInt64(&origin.active, -1)
+        if !cancelled {
+            pool.failed(origin, err.Error())
+        }
+        log.Println("http: proxy error: %v", err)
+        return nil, err
+    }
+    if resp.StatusCode >= 500 {
+        pool.failed(origin, resp.Status)
+    } else {
+        pool.succeeded(origin)
+    }
+    resp.Body = &originBody{ReadCloser: resp.Body, origin: origin}
+    return resp, nil
+}
+
+// Refetch an entry that is being served stale. Runs alongside sending
+// the stale copy to the client, and may outlive the client's request,
+// so the request is detached from the client's.
+func (p proxyHandler) refresh(req *http.Request, cacheKey string, t *Target, expired []byte) {
+    if err := p.fetch(req.Clone(context.Background()), cacheKey, expired, t); err != nil {
+        log.Println("Background refresh of", t.key, "failed:", err)
+    }
+}
+
+// Answer a request with a response from the cache or from a request
+// it was collapsed on, handling the client's conditionals and ranges
+func serveResponse(rw http.ResponseWriter, req *http.Request, resp *http.Response, l *AccessLog) {
+    if code := checkConditions(req, resp); code != 0 {
+        respondConditional(resp, rw, code)
+        resp.StatusCode = code
+        resp.Status = http.StatusText(code)
+        resp.ContentLength = 0
+    } else if req.Header.Get("Range") != "" && resp.StatusCode == http.StatusOK {
+        serveRange(resp, rw, req)
+    } else {
+        respond(resp, rw)
+    }
+    l.ParseResp(resp)
 }
 
 // handler method
@@ -159,64 +215,139 @@ func proxy(lc *LocationConfig, req  *http.Request) (*http.Response, error) {
 // If request is cached, serve from cache
 // Otherwise proxy and cache the response according to config
 func (p proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-    l := NewAccessLog()
+    p.serve(rw, req, NewAccessLog())
+}
+
+// serve a request, leaving what happened to it in l
+func (p proxyHandler) serve(rw http.ResponseWriter, req *http.Request, l *AccessLog) {
     l.ParseReq(req)
+    if (req.Method == "PURGE" || req.Method == "BAN") && len(p.Config.PurgeNets) > 0 {
+        p.servePurge(rw, req, l)
+        l.Log()
+        return
+    }
     var b []byte
-    origin, _ := url.Parse(p.Config.Origin)
-    cacheKey := p.Config.GetCacheKey(req)
-    data, status := cache.Get(cacheKey)
-    if status == "MISS" || status == "EXPIRED" {
-        // ORDER OF CONDITIONS IS VERY IMPORTANT
-        if !cacheableRequest(req) || p.Config.ByPass || p.Config.ActiveRequests.Start(cacheKey)  {
-            var err error
 
-            t := time.Now()
+    // HEAD is answered from the GET entry, fetching a GET to fill it.
+    // The server drops the body since rw still belongs to the HEAD.
+    if req.Method == "HEAD" && cacheableRequest(req) && !p.Config.ByPass {
+        get := new(http.Request)
+        *get = *req
+        get.Method = "GET"
+        req = get
+    }
+    p.Config.normalizeVary(req)
+    baseKey := p.Config.GetCacheKey(req)
+    collapse := cacheableRequest(req) && !p.Config.ByPass
+    l.Scheme = p.Config.Pool.Origins[0].URL.Scheme
 
-            resp, err := proxy(p.Config, req)
-            if err != nil {
-                log.Println("http: proxy error:", err)
-                rw.WriteHeader(http.StatusInternalServerError)
-                p.Config.ActiveRequests.Stop(cacheKey, b)
+    if p.Config.SliceSize > 0 && collapse && req.Header.Get("Range") != "" && cacheLookupAllowed(req) {
+        if p.serveSlices(rw, req, baseKey, l) {
+            l.Log()
+            return
+        }
+    }
+
+    cacheKey, entry, status := lookupVariant(baseKey, req)
+    if status != "MISS" && !cacheLookupAllowed(req) {
+        status = "BYPASS"
+    }
+
+    if status == "EXPIRED" && collapse && entry.staleWithin(entry.StaleWhileRevalidate) {
+        // serve stale now and refresh in the background,
+        // unless a request for it is already in flight
+        if t := p.Config.ActiveRequests.TryStart(cacheKey); t != nil {
+            go p.refresh(req, baseKey, t, entry.Response)
+        }
+        status = "STALE"
+        b = entry.Response
+    } else if status == "MISS" || status == "EXPIRED" || status == "BYPASS" {
+        var t *Target
+        leader := true
+        if collapse {
+            t, leader = p.Config.ActiveRequests.Start(cacheKey)
+        }
+        var err error
+        if !leader {
+            var resp *http.Response
+            if resp, err = t.Wait(p.Config.collapseTimeout()); err == nil {
+                l.CacheStatus = "COLLAPSED"
+                p.Config.stripTags(resp.Header)
+                serveResponse(rw, req, resp, l)
+                l.Log()
                 return
             }
-            l.OriginTime = time.Since(t)
+            // Responses that aren't cacheable are not shared, so
+            // waiters make their own request instead, as they do when
+            // the leader is slow. Those, like uncacheable requests, go
+            // to the origin as they are and its response is passed on.
+            if err == errNotShared || err == errCollapseTimeout {
+                err = nil
+            }
+            t = nil
+        }
 
-            b, err = httputil.DumpResponse(resp, true)
-            if err != nil {
-                if status == "EXPIRED" {
-                    status = "STALE"
-                    b = data
-                } else {
-                    log.Println("Error reading proxy response:", err)
-                    rw.WriteHeader(http.StatusInternalServerError)
-                    p.Config.ActiveRequests.Stop(cacheKey, b)
-                    return
+        if err == nil {
+            var expired []byte
+            if t != nil && status != "MISS" {
+                expired = entry.Response
+            }
+            var resp *http.Response
+            var revalidated bool
+            resp, revalidated, err = p.originRequest(req, t != nil, expired, l)
+            if err == nil && status == "EXPIRED" && originError(resp.StatusCode) && entry.staleWithin(entry.StaleIfError) {
+                // an error from the origin is no better than none
+                resp.Body.Close()
+                err = errors.New("origin answered " + resp.Status)
+            }
+            if err == nil {
+                if revalidated {
+                    status = "REVALIDATED"
                 }
+                l.CacheStatus = status
+                p.serveOrigin(rw, req, resp, baseKey, t, l)
+                l.Log()
+                return
             }
-            if cacheableRequest(req) && cacheableResponse(resp) && !p.Config.ByPass {
-                cache.Set(cacheKey, b, p.Config.Expire)
-                p.Config.ActiveRequests.Stop(cacheKey, b)
+            if t != nil {
+                t.Finish(err)
             }
+        }
+
+        // the leader's error is the waiters' error too. With the
+        // breakers open any stale copy is better than none.
+        if status == "EXPIRED" && (entry.staleWithin(entry.StaleIfError) || err == errCircuitOpen) {
+            log.Println("http: proxy error, serving stale:", err)
+            status = "STALE"
+            b = entry.Response
+        } else if err == errCircuitOpen {
+            code := p.Config.serveCircuitOpen(rw)
+            l.CacheStatus = status
+            l.ParseError(code)
+            l.Log()
+            return
         } else {
-            b = p.Config.ActiveRequests.Wait(cacheKey)
-            status = "COLLAPSED"
+            log.Println("http: proxy error:", err)
+            code := originErrorStatus(err)
+            rw.WriteHeader(code)
+            l.CacheStatus = status
+            l.ParseError(code)
+            l.Log()
+            return
         }
+    } else {
+        b = entry.Response
     }
-    if status == "HIT" {
-        b = data
-    }    
     l.CacheStatus = status
-    l.Scheme = origin.Scheme
 
-    buf := bytes.NewBuffer(b)
-    resp, err := http.ReadResponse(bufio.NewReader(buf), req)
+    resp, err := readCachedResponse(b, req)
     if err != nil {
         log.Println(err)
         rw.WriteHeader(http.StatusInternalServerError)
         return
     }
-    respond(resp, rw)
-    l.ParseResp(resp)
+    p.Config.stripTags(resp.Header)
+    serveResponse(rw, req, resp, l)
     l.Log()
 }
 
@@ -227,13 +358,12 @@ func NewHandlerFunc(conf *LocationConfig) func(http.ResponseWriter, *http.Reques
     return p.ServeHTTP
 }
 
-// initialize global settings
-func init() {
-    cache = NewCache(1024)
-}
-
 // start server
 func StartProxy() error {
+    var err error
+    if cache, err = NewCacheBackend(config.Cache); err != nil {
+        return err
+    }
     if err := loadVhosts(config.VhostPath); err != nil {
         log.Println("Warning:", err)
     }
@@ -244,6 +374,7 @@ func StartProxy() error {
         }
         for loc, locCfg := range cfg.Location {
             ports[cfg.Port].HandleFunc(vhost+loc, NewHandlerFunc(locCfg))   
+            locCfg.Pool.startHealthChecks()
         }
     }
     var wg sync.WaitGroup
@@ -254,8 +385,8 @@ func StartProxy() error {
             server := &http.Server{
                 Addr:           config.Server + ":" + strconv.Itoa(p),
                 Handler:        sm,
-                ReadTimeout:    60 * time.Second,
-                WriteTimeout:   60 * time.Second,
+                ReadTimeout:    seconds(config.ReadTimeout, defaultReadTimeout),
+                WriteTimeout:   seconds(config.WriteTimeout, defaultWriteTimeout),
                 MaxHeaderBytes: 0,
             }
             if err := server.ListenAndServe(); err != nil {
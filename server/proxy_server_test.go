@@ -0,0 +1,161 @@
+package server
+
+import (
+	"log"
+	"fmt"
+	"time"
+	"bytes"
+	"strings"
+	"net/http"
+	"sync/atomic"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// A location in front of origin, as getConfig would set it up,
+// changed by mod first if set. The global cache is replaced by
+// an empty one for it.
+func testLocation(origin string, mod func(*LocationConfig)) *LocationConfig {
+	lc := &LocationConfig{
+		Origin:     origin,
+		CacheKey:   "$method $host$uri$querystring",
+		Expire:     60,
+		ExpireMode: ExpireOrigin,
+	}
+	if mod != nil {
+		mod(lc)
+	}
+	pool, err := newOriginPool(lc)
+	Expect(err).NotTo(HaveOccurred())
+	lc.Pool = pool
+	lc.PurgeNets, err = parseACL(lc.PurgeACL)
+	Expect(err).NotTo(HaveOccurred())
+	lc.ActiveRequests = &ActiveRequests{
+		Targets: make(map[string]*Target),
+		MaxSize: lc.MaxObjectSize,
+	}
+	cache = NewCache(1 << 20)
+	return lc
+}
+
+// Send a request for path on example.com through the location,
+// with headers given as name and value pairs
+func serve(lc *LocationConfig, method, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://example.com" + path, nil)
+	for i := 0; i + 1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i + 1])
+	}
+	rw := httptest.NewRecorder()
+	NewHandlerFunc(lc)(rw, req)
+	return rw
+}
+
+// Like serve, also returning the $cache_status the request was logged with
+func serveStatus(lc *LocationConfig, method, path string, header ...string) (*httptest.ResponseRecorder, string) {
+	var buf bytes.Buffer
+	logged := accessLogger
+	accessLogger = []*AccessLogger{{Logger: log.New(&buf, "", 0), Format: "$cache_status"}}
+	defer func() { accessLogger = logged }()
+	rw := serve(lc, method, path, header...)
+	return rw, strings.TrimSpace(buf.String())
+}
+
+var _ = Describe("Stale responses", func() {
+
+	var (
+		origin  *httptest.Server
+		hits    int32
+		code    int32
+		cc      atomic.Value
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&hits, 0)
+		atomic.StoreInt32(&code, http.StatusOK)
+		cc.Store("max-age=60")
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&hits, 1)
+			c := int(atomic.LoadInt32(&code))
+			if c == 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Cache-Control", cc.Load().(string))
+			w.WriteHeader(c)
+			fmt.Fprintf(w, "response %d", n)
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	// expire the cached copy of /a, d ago
+	expire := func(d time.Duration) {
+		Expect(cache.SetExpires("GET example.com/a", time.Now().Add(-d))).To(BeTrue())
+	}
+
+	It("serves stale while revalidating in the background", func() {
+		cc.Store("max-age=60, stale-while-revalidate=30")
+		lc := testLocation(origin.URL, nil)
+		serve(lc, "GET", "/a")
+		expire(time.Second)
+
+		r, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("STALE"))
+		Expect(r.Body.String()).To(Equal("response 1"))
+		Eventually(func() bool {
+			e, _ := cache.Peek("GET example.com/a")
+			return e != nil && !e.expired()
+		}).Should(BeTrue())
+		r, status = serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Body.String()).To(Equal("response 2"))
+
+		// past the window the client waits for the origin
+		expire(time.Minute)
+		r, status = serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(r.Body.String()).To(Equal("response 3"))
+	})
+
+	It("serves stale when the origin fails, within stale_if_error", func() {
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.StaleIfError = 60
+		})
+		serve(lc, "GET", "/a")
+		for _, c := range []int32{http.StatusServiceUnavailable, http.StatusInternalServerError, 0} {
+			expire(time.Second)
+			atomic.StoreInt32(&code, c)
+			r, status := serveStatus(lc, "GET", "/a")
+			Expect(status).To(Equal("STALE"), fmt.Sprint(c))
+			Expect(r.Code).To(Equal(http.StatusOK), fmt.Sprint(c))
+			Expect(r.Body.String()).To(Equal("response 1"), fmt.Sprint(c))
+		}
+
+		// a 404 is an answer rather than a failure
+		atomic.StoreInt32(&code, http.StatusNotFound)
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusNotFound))
+
+		serve(lc, "GET", "/a")
+		atomic.StoreInt32(&code, http.StatusOK)
+		serve(lc, "GET", "/a")
+		expire(2 * time.Minute)
+		atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("doesn't serve stale copies the origin must revalidate", func() {
+		cc.Store("max-age=60, must-revalidate")
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.StaleIfError = 60
+			lc.StaleWhileRevalidate = 60
+		})
+		serve(lc, "GET", "/a")
+		expire(time.Second)
+		atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+		r, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(r.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -0,0 +1,230 @@
+package server
+
+import (
+    "io"
+    "net"
+    "time"
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+)
+
+var errNoCache = errors.New("Cache is not running.")
+
+// marks a purge as soft, expiring objects instead of removing them
+const softFlag = "-soft"
+
+// admin commands for removing objects from the cache
+func registerPurgeCommands() {
+    cmds["purge"] = &Command{
+        "purge",
+        "Remove objects from the cache: purge [-soft] key|url|prefix|regex|vhost|tag|all ...",
+        []string{},
+        map[string]*Command{
+            "key": purgeCommand("key", "<cachekey>", 1, func(args []string, soft bool) (int, error) {
+                return purgeKey(strings.Join(args, " "), soft), nil
+            }),
+            "url": purgeCommand("url", "<url>", 1, func(args []string, soft bool) (int, error) {
+                u, err := url.Parse(args[0])
+                if err != nil {
+                    return 0, err
+                }
+                lc := findLocation(u.Host, u.Path)
+                if lc == nil {
+                    return 0, errors.New("No location is configured for " + args[0] + ".")
+                }
+                return purgeURL(lc, u, soft), nil
+            }),
+            "prefix": purgeCommand("prefix", "<prefix>", 1, func(args []string, soft bool) (int, error) {
+                prefix := strings.Join(args, " ")
+                return cache.PurgeMatch(func(key string, e *Entry) bool {
+                    return strings.HasPrefix(key, prefix)
+                }, soft), nil
+            }),
+            "regex": purgeCommand("regex", "<regex>", 1, func(args []string, soft bool) (int, error) {
+                re, err := regexp.Compile(strings.Join(args, " "))
+                if err != nil {
+                    return 0, err
+                }
+                return cache.PurgeMatch(func(key string, e *Entry) bool {
+                    return re.MatchString(key)
+                }, soft), nil
+            }),
+            "vhost": purgeCommand("vhost", "<host>", 1, func(args []string, soft bool) (int, error) {
+                // every name of a configured vhost
+                hosts := map[string]bool{args[0]: true}
+                if v, ok := vHosts[args[0]]; ok {
+                    for _, h := range v.VHosts {
+                        hosts[h] = true
+                    }
+                }
+                return cache.PurgeMatch(func(key string, e *Entry) bool {
+                    return hosts[e.Host]
+                }, soft), nil
+            }),
+            "tag": purgeCommand("tag", "<tag...>", 1, func(args []string, soft bool) (int, error) {
+                return cache.PurgeTags(args, soft), nil
+            }),
+            "all": purgeCommand("all", "", 0, func(args []string, soft bool) (int, error) {
+                return cache.PurgeMatch(func(key string, e *Entry) bool {
+                    return true
+                }, soft), nil
+            }),
+        },
+        func(context []string) (reply string, err error) {
+            args, soft := parseSoftFlag(context)
+            if soft && len(args) > 0 {
+                // passed on to the subcommand, after its name
+                args = append([]string{args[0], softFlag}, args[1:]...)
+            }
+            return runSubcommand("purge", args)
+        },
+    }
+}
+
+// A purge subcommand taking at least min arguments. Its
+// reply is the number of objects purged.
+func purgeCommand(name, args string, min int, purge func(args []string, soft bool) (int, error)) *Command {
+    return subcommand("purge [-soft]", name, args, min, withCache(func(context []string) (string, error) {
+        args, soft := parseSoftFlag(context)
+        n, err := purge(args, soft)
+        if err != nil {
+            return "", err
+        }
+        if soft {
+            return "Expired " + strconv.Itoa(n) + " objects.", nil
+        }
+        return "Purged " + strconv.Itoa(n) + " objects.", nil
+    }), softFlag)
+}
+
+func parseSoftFlag(context []string) ([]string, bool) {
+    if len(context) > 0 && context[0] == softFlag {
+        return context[1:], true
+    }
+    return context, false
+}
+
+// Purge a key along with its variants and slices, which
+// are found through the tag linking them to the key
+func purgeKey(key string, soft bool) int {
+    n := cache.PurgeTags([]string{keyTag(key)}, soft)
+    if !soft {
+        if cache.Delete(key) {
+            n++
+        }
+    } else if e, _ := cache.Peek(key); e != nil {
+        if !e.expired() {
+            cache.SetExpires(key, time.Now())
+        }
+        n++
+    }
+    return n
+}
+
+// Purge the objects cached for a URL at a location. Keys built from
+// cookies or request headers can't be rebuilt from the URL alone, so
+// objects are then matched by the URL they were cached for instead,
+// which takes every variant of it.
+func purgeURL(lc *LocationConfig, u *url.URL, soft bool) int {
+    if !lc.keyUsesHeaders() {
+        return purgeKey(lc.urlCacheKey(u), soft)
+    }
+    host, query := stripPort(u.Host), lc.keyQuery(u.RawQuery)
+    return cache.PurgeMatch(func(k string, e *Entry) bool {
+        eu, err := url.ParseRequestURI(e.URL)
+        return err == nil && strings.EqualFold(e.Host, host) && eu.Path == u.Path &&
+            lc.keyQuery(eu.RawQuery) == query
+    }, soft)
+}
+
+// Parse a list of addresses and networks in CIDR notation,
+// a single address being a network of just that address
+func parseACL(acl []string) ([]*net.IPNet, error) {
+    nets := make([]*net.IPNet, 0, len(acl))
+    for _, a := range acl {
+        if !strings.Contains(a, "/") {
+            ip := net.ParseIP(a)
+            if ip == nil {
+                return nil, errors.New("invalid address " + a)
+            }
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 8 * net.IPv4len
+            }
+            a = ip.String() + "/" + strconv.Itoa(bits)
+        }
+        _, n, err := net.ParseCIDR(a)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+// whether a client may purge at this location, from
+// the purge_acl parsed when the config was loaded
+func (lc *LocationConfig) purgeAllowed(remoteAddr string) bool {
+    ip := net.ParseIP(stripPort(remoteAddr))
+    if ip == nil {
+        return false
+    }
+    for _, n := range lc.PurgeNets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Handle the PURGE and BAN methods at locations with purge_acl set.
+// PURGE removes the object cached for the request URL. BAN, as in
+// Varnish, removes every object of the request's host whose URL
+// matches the regex in X-Ban-Url, or the request URL itself if the
+// header isn't set.
+func (p proxyHandler) servePurge(rw http.ResponseWriter, req *http.Request, l *AccessLog) {
+    l.CacheStatus = req.Method
+    code, reply := http.StatusOK, ""
+    if !p.Config.purgeAllowed(req.RemoteAddr) {
+        code, reply = http.StatusForbidden, "Purging is not allowed from " + req.RemoteAddr + "."
+    } else if req.Method == "PURGE" {
+        get := new(http.Request)
+        *get = *req
+        get.Method = "GET"
+        n := purgeKey(p.Config.GetCacheKey(get), false)
+        if n == 0 {
+            code = http.StatusNotFound
+        }
+        reply = "Purged " + strconv.Itoa(n) + " objects."
+    } else {
+        expr := req.Header.Get("X-Ban-Url")
+        if expr == "" {
+            expr = req.URL.RequestURI()
+        }
+        re, err := regexp.Compile(expr)
+        if err != nil {
+            code, reply = http.StatusBadRequest, err.Error()
+        } else {
+            host := stripPort(req.Host)
+            n := cache.PurgeMatch(func(key string, e *Entry) bool {
+                return e.Host == host && re.MatchString(e.URL)
+            }, false)
+            reply = "Banned " + strconv.Itoa(n) + " objects."
+        }
+    }
+
+    reply += "\n"
+    rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    rw.WriteHeader(code)
+    io.WriteString(rw, reply)
+    l.ParseResp(&http.Response{
+        Status:         http.StatusText(code),
+        StatusCode:     code,
+        ContentLength:  int64(len(reply)),
+        Request:        req,
+    })
+}
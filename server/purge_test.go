@@ -0,0 +1,142 @@
+package server
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"strings"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// a cache that fails specs scanning it
+type noScanCache struct {
+	CacheBackend
+}
+
+func (c noScanCache) PurgeMatch(match func(key string, e *Entry) bool, soft bool) int {
+	Fail("the whole cache was scanned")
+	return 0
+}
+
+var _ = Describe("Purging", func() {
+
+	var (
+		origin  *httptest.Server
+		hits    int
+	)
+
+	BeforeEach(func() {
+		hits = 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			fmt.Fprintf(w, "%s %s %d", r.Method, r.URL, hits)
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("answers PURGE and BAN from addresses in purge_acl", func() {
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.PurgeACL = []string{"192.0.2.0/24", "::1"}
+		})
+		for _, path := range []string{"/a", "/img/1.png", "/img/2.png", "/b"} {
+			serve(lc, "GET", path)
+		}
+
+		r := serve(lc, "PURGE", "/a")
+		Expect(r.Code).To(Equal(http.StatusOK))
+		Expect(r.Body.String()).To(Equal("Purged 1 objects.\n"))
+		Expect(serve(lc, "GET", "/a").Body.String()).To(Equal("GET /a 5"))
+		Expect(serve(lc, "PURGE", "/missing").Code).To(Equal(http.StatusNotFound))
+
+		r = serve(lc, "BAN", "/", "X-Ban-Url", `^/img/.*\.png$`)
+		Expect(r.Code).To(Equal(http.StatusOK))
+		Expect(r.Body.String()).To(Equal("Banned 2 objects.\n"))
+		Expect(serve(lc, "GET", "/img/1.png").Body.String()).To(Equal("GET /img/1.png 6"))
+		Expect(serve(lc, "GET", "/b").Body.String()).To(Equal("GET /b 4"))
+		Expect(serve(lc, "BAN", "/", "X-Ban-Url", "(").Code).To(Equal(http.StatusBadRequest))
+
+		req := httptest.NewRequest("PURGE", "http://example.com/b", nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		rw := httptest.NewRecorder()
+		NewHandlerFunc(lc)(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusForbidden))
+		Expect(serve(lc, "GET", "/b").Body.String()).To(Equal("GET /b 4"))
+	})
+
+	It("passes PURGE on to the origin without a purge_acl", func() {
+		lc := testLocation(origin.URL, nil)
+		serve(lc, "GET", "/a")
+		Expect(serve(lc, "PURGE", "/a").Body.String()).To(Equal("PURGE /a 2"))
+		Expect(serve(lc, "GET", "/a").Body.String()).To(Equal("GET /a 1"))
+	})
+
+	It("parses purge_acl once, when the config is loaded", func() {
+		if vHosts == nil {
+			vHosts = make(map[string]*vHost)
+		}
+		dir, err := ioutil.TempDir("", "pongo")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		load := func(acl string) error {
+			path := filepath.Join(dir, "vhost.json")
+			conf := `{"vhosts": ["purge.test"], "location": {"/": {"origin": "` + origin.URL + `", "purge_acl": ` + acl + `}}}`
+			Expect(ioutil.WriteFile(path, []byte(conf), 0644)).To(Succeed())
+			return getConfig(path)
+		}
+		defer delete(vHosts, "purge.test")
+
+		Expect(load(`["10.0.0.0/33"]`)).To(MatchError(ContainSubstring("Invalid purge_acl for location /")))
+		Expect(load(`["not an address"]`)).To(MatchError(ContainSubstring("Invalid purge_acl for location /")))
+		Expect(load(`["10.0.0.0/8", "192.0.2.1", "::1"]`)).To(Succeed())
+		lc := vHosts["purge.test"].Location["/"]
+		Expect(lc.PurgeNets).To(HaveLen(3))
+		Expect(lc.purgeAllowed("10.1.2.3:1234")).To(BeTrue())
+		Expect(lc.purgeAllowed("192.0.2.1:1234")).To(BeTrue())
+		Expect(lc.purgeAllowed("192.0.2.2:1234")).To(BeFalse())
+		Expect(lc.purgeAllowed("[::1]:1234")).To(BeTrue())
+	})
+
+	It("purges a key with its variants and slices without scanning the cache", func() {
+		content := strings.Repeat("0123456789", 3)
+		origin.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v" {
+				w.Header().Set("Vary", "Accept-Language")
+			}
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+		})
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.SliceSize = 10
+		})
+		Expect(serve(lc, "GET", "/big", "Range", "bytes=5-25").Code).To(Equal(http.StatusPartialContent))
+		serve(lc, "GET", "/v", "Accept-Language", "en")
+		serve(lc, "GET", "/v", "Accept-Language", "fr")
+		serve(lc, "GET", "/other")
+		keys := func() []string {
+			keys := cache.Keys(func(string) bool { return true }, 0)
+			sort.Strings(keys)
+			return keys
+		}
+		Expect(keys()).To(HaveLen(7))
+
+		cache = noScanCache{cache}
+		Expect(purgeKey("GET example.com/big", false)).To(Equal(3))
+		Expect(purgeKey("GET example.com/v", true)).To(Equal(3))
+		Expect(keys()).To(HaveLen(4))
+		for _, k := range keys()[1:] {
+			e, _ := cache.Peek(k)
+			Expect(e.expired()).To(BeTrue(), k)
+			Expect(strings.HasPrefix(k, "GET example.com/v")).To(BeTrue(), k)
+		}
+		Expect(purgeKey("GET example.com/v", false)).To(Equal(3))
+		Expect(keys()).To(Equal([]string{"GET example.com/other"}))
+	})
+})
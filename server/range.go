@@ -0,0 +1,58 @@
+package server
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+)
+
+// keeps track of what was written for the access log
+type statusWriter struct {
+    http.ResponseWriter
+    status      int
+    written     int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+    w.status = code
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.status = http.StatusOK
+    }
+    n, err := w.ResponseWriter.Write(b)
+    w.written += int64(n)
+    return n, err
+}
+
+// Answer a Range request from a complete cached response.
+// http.ServeContent takes care of If-Range, multipart ranges
+// and answering 416 to ranges that can't be satisfied.
+func serveRange(res *http.Response, rw http.ResponseWriter, req *http.Request) {
+    body, err := ioutil.ReadAll(res.Body)
+    if err != nil {
+        rw.WriteHeader(http.StatusInternalServerError)
+        res.StatusCode = http.StatusInternalServerError
+        return
+    }
+    copyHeader(rw.Header(), res.Header)
+    rw.Header().Del("Content-Length")
+    modtime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+    sw := &statusWriter{ResponseWriter: rw}
+    http.ServeContent(sw, req, "", modtime, bytes.NewReader(body))
+    res.StatusCode = sw.status
+    res.Status = http.StatusText(sw.status)
+    res.ContentLength = sw.written
+}
+
+// whether an If-Range validator still matches the response,
+// entity tags are compared strongly and dates exactly
+func ifRangeMatches(ir string, res *http.Response) bool {
+    if len(ir) > 0 && (ir[0] == '"' || len(ir) > 2 && ir[:2] == "W/") {
+        return etagMatches(ir, res.Header.Get("Etag"), false)
+    }
+    return ir == res.Header.Get("Last-Modified")
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ranges", func() {
+
+	var (
+		origin  *httptest.Server
+		content []byte
+		ranges  []string
+		mu      sync.Mutex
+		partial bool
+	)
+
+	// the Range headers the origin received since the last call
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		r := ranges
+		ranges = nil
+		return r
+	}
+
+	BeforeEach(func() {
+		content = bytes.Repeat([]byte("0123456789"), 100)
+		ranges = nil
+		partial = true
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Etag", `"v1"`)
+			if !partial {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("answers ranges from the whole cached object", func() {
+		lc := testLocation(origin.URL, nil)
+		r, status := serveStatus(lc, "GET", "/a", "Range", "bytes=10-19")
+		Expect(status).To(Equal("MISS"))
+		Expect(r.Code).To(Equal(http.StatusPartialContent))
+		Expect(r.Body.String()).To(Equal(string(content[10:20])))
+		Expect(received()).To(Equal([]string{""}))
+
+		r, status = serveStatus(lc, "GET", "/a", "Range", "bytes=995-")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Code).To(Equal(http.StatusPartialContent))
+		Expect(r.Header().Get("Content-Range")).To(Equal("bytes 995-999/1000"))
+		Expect(r.Body.String()).To(Equal("56789"))
+
+		r = serve(lc, "GET", "/a", "Range", "bytes=0-1,5-6")
+		Expect(r.Code).To(Equal(http.StatusPartialContent))
+		Expect(r.Header().Get("Content-Type")).To(HavePrefix("multipart/byteranges"))
+
+		r = serve(lc, "GET", "/a", "Range", "bytes=2000-")
+		Expect(r.Code).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+
+		r = serve(lc, "GET", "/a", "Range", "bytes=0-9", "If-Range", `"v0"`)
+		Expect(r.Code).To(Equal(http.StatusOK))
+		Expect(r.Body.Len()).To(Equal(len(content)))
+		Expect(received()).To(BeEmpty())
+	})
+
+	Context("with slice_size set", func() {
+
+		var lc *LocationConfig
+
+		BeforeEach(func() {
+			lc = testLocation(origin.URL, func(lc *LocationConfig) {
+				lc.SliceSize = 100
+			})
+		})
+
+		It("fetches and caches only the slices a range covers", func() {
+			r, status := serveStatus(lc, "GET", "/a", "Range", "bytes=150-249")
+			Expect(status).To(Equal("MISS"))
+			Expect(r.Code).To(Equal(http.StatusPartialContent))
+			Expect(r.Header().Get("Content-Range")).To(Equal("bytes 150-249/1000"))
+			Expect(r.Body.String()).To(Equal(string(content[150:250])))
+			Expect(received()).To(Equal([]string{"bytes=100-199", "bytes=200-299"}))
+
+			keys := cache.Keys(func(k string) bool { return strings.Contains(k, "#slice=") }, 0)
+			Expect(keys).To(ConsistOf("GET example.com/a#slice=1", "GET example.com/a#slice=2"))
+
+			r, status = serveStatus(lc, "GET", "/a", "Range", "bytes=120-180")
+			Expect(status).To(Equal("HIT"))
+			Expect(r.Body.String()).To(Equal(string(content[120:181])))
+			Expect(received()).To(BeEmpty())
+
+			r = serve(lc, "GET", "/a", "Range", "bytes=950-")
+			Expect(r.Header().Get("Content-Range")).To(Equal("bytes 950-999/1000"))
+			Expect(r.Body.String()).To(Equal(string(content[950:])))
+			Expect(received()).To(Equal([]string{"bytes=900-999"}))
+		})
+
+		It("caches the whole object from an origin that ignores ranges", func() {
+			partial = false
+			r := serve(lc, "GET", "/a", "Range", "bytes=150-249")
+			Expect(r.Code).To(Equal(http.StatusPartialContent))
+			Expect(r.Body.String()).To(Equal(string(content[150:250])))
+
+			e, _ := cache.Peek("GET example.com/a")
+			Expect(e).NotTo(BeNil())
+			r, status := serveStatus(lc, "GET", "/a", "Range", "bytes=500-509")
+			Expect(status).To(Equal("HIT"))
+			Expect(r.Body.String()).To(Equal(string(content[500:510])))
+			Expect(received()).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,120 @@
+package server
+
+import (
+    "sync"
+    "time"
+    "net/http"
+)
+
+// retry defaults, the backoff in milliseconds
+const (
+    defaultRetryBackoff     = 100
+    defaultRetryBudget      = 0.2
+    defaultRetryBudgetMin   = 10
+)
+
+// longest wait between two attempts of a request
+const maxRetryBackoff = 2 * time.Second
+
+// period the retry budget is counted over
+const retryBudgetWindow = 10 * time.Second
+
+// Caps the retries of a location to a share of its requests, so an
+// origin that is failing everything doesn't also get every request
+// again. min retries are allowed in each window whatever the traffic.
+type retryBudget struct {
+    lock        sync.Mutex
+    ratio       float64
+    min         int
+    start       time.Time
+    requests    int
+    retries     int
+}
+
+func newRetryBudget(ratio float64, min int) *retryBudget {
+    if ratio <= 0 {
+        ratio = defaultRetryBudget
+    }
+    if min <= 0 {
+        min = defaultRetryBudgetMin
+    }
+    return &retryBudget{ratio: ratio, min: min, start: time.Now()}
+}
+
+// start a new window once the current one is over, under the lock
+func (b *retryBudget) roll() {
+    if time.Since(b.start) >= retryBudgetWindow {
+        b.start = time.Now()
+        b.requests, b.retries = 0, 0
+    }
+}
+
+// count a request sent to the origin for the first time
+func (b *retryBudget) request() {
+    b.lock.Lock()
+    b.roll()
+    b.requests++
+    b.lock.Unlock()
+}
+
+// take a retry from the budget, false if it is spent
+func (b *retryBudget) withdraw() bool {
+    b.lock.Lock()
+    defer b.lock.Unlock()
+    b.roll()
+    if b.retries >= b.min + int(b.ratio * float64(b.requests)) {
+        return false
+    }
+    b.retries++
+    return true
+}
+
+// Whether a request can be sent again after it failed. Only
+// idempotent methods are, and only without a body since the
+// body of a client's request can't be read twice.
+func (lc *LocationConfig) retryable(req *http.Request) bool {
+    if lc.Retries <= 0 || req.Body != nil && req.Body != http.NoBody {
+        return false
+    }
+    switch req.Method {
+    case "GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE":
+        return true
+    }
+    return false
+}
+
+// whether an attempt failed in a way worth trying another origin for
+func (lc *LocationConfig) retryOn(resp *http.Response, err error) bool {
+    if err != nil {
+        return true
+    }
+    for _, code := range lc.RetryOnStatus {
+        if resp.StatusCode == code {
+            return true
+        }
+    }
+    return false
+}
+
+// Wait before the given retry, doubling the backoff each time.
+// Returns false if the request was cancelled while waiting.
+func (lc *LocationConfig) backoff(req *http.Request, retry int) bool {
+    d := time.Duration(lc.RetryBackoff) * time.Millisecond
+    if d <= 0 {
+        d = defaultRetryBackoff * time.Millisecond
+    }
+    for i := 1; i < retry && d < maxRetryBackoff; i++ {
+        d *= 2
+    }
+    if d > maxRetryBackoff {
+        d = maxRetryBackoff
+    }
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-t.C:
+        return true
+    case <-req.Context().Done():
+        return false
+    }
+}
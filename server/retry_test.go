@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"net/http"
+	"sync/atomic"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retries", func() {
+
+	var (
+		failing *httptest.Server
+		fails   int32
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&fails, 0)
+		failing = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fails, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	})
+
+	AfterEach(func() {
+		failing.Close()
+	})
+
+	retrying := func(lc *LocationConfig) {
+		lc.Retries = 2
+		lc.RetryBackoff = 1
+		lc.RetryOnStatus = []int{http.StatusServiceUnavailable}
+	}
+
+	It("sends idempotent requests again up to retries times", func() {
+		lc := testLocation(failing.URL, retrying)
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&fails)).To(BeNumerically("==", 3))
+
+		req := httptest.NewRequest("POST", "http://example.com/b", strings.NewReader("x"))
+		rw := httptest.NewRecorder()
+		NewHandlerFunc(lc)(rw, req)
+		Expect(rw.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&fails)).To(BeNumerically("==", 4))
+	})
+
+	It("moves on to the next origin", func() {
+		ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer ok.Close()
+		lc := testLocation("", func(lc *LocationConfig) {
+			retrying(lc)
+			lc.Retries = 1
+			lc.Origins = []OriginConfig{{URL: failing.URL}, {URL: ok.URL}}
+		})
+		for _, p := range []string{"/a", "/b", "/c", "/d"} {
+			r := serve(lc, "GET", p)
+			Expect(r.Code).To(Equal(http.StatusOK))
+			Expect(r.Body.String()).To(Equal("ok"))
+		}
+		Expect(atomic.LoadInt32(&fails)).To(BeNumerically(">", 0))
+	})
+
+	It("stops retrying once the budget is spent", func() {
+		lc := testLocation(failing.URL, func(lc *LocationConfig) {
+			retrying(lc)
+			lc.RetryBudget = 0.01
+			lc.RetryBudgetMin = 2
+		})
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&fails)).To(BeNumerically("==", 3))
+		for _, p := range []string{"/b", "/c", "/d"} {
+			Expect(serve(lc, "GET", p).Code).To(Equal(http.StatusServiceUnavailable))
+		}
+		Expect(atomic.LoadInt32(&fails)).To(BeNumerically("==", 6))
+	})
+})
@@ -0,0 +1,59 @@
+package server
+
+import (
+    "bytes"
+    "bufio"
+    "net/http"
+)
+
+// Conditional request headers. Dropped from requests made to fill
+// the cache, since the answer to them is specific to one client.
+var conditionalHeaders = []string{
+    "If-Match",
+    "If-None-Match",
+    "If-Modified-Since",
+    "If-Unmodified-Since",
+}
+
+// parse a response as it was serialized into the cache
+func readCachedResponse(b []byte, req *http.Request) (*http.Response, error) {
+    return http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+}
+
+// Copy of req to send to the origin when filling the cache. When
+// an expired copy is given, its ETag and Last-Modified are sent as
+// validators so the origin can answer with 304 Not Modified.
+func cacheFillRequest(req *http.Request, expired *http.Response) *http.Request {
+    outreq := new(http.Request)
+    *outreq = *req
+    outreq.Header = make(http.Header)
+    copyHeader(outreq.Header, req.Header)
+    for _, h := range conditionalHeaders {
+        outreq.Header.Del(h)
+    }
+    // the whole object is cached and ranges are served from it
+    outreq.Header.Del("Range")
+    outreq.Header.Del("If-Range")
+
+    if expired != nil {
+        if etag := expired.Header.Get("Etag"); etag != "" {
+            outreq.Header.Set("If-None-Match", etag)
+        }
+        if lm := expired.Header.Get("Last-Modified"); lm != "" {
+            outreq.Header.Set("If-Modified-Since", lm)
+        }
+    }
+    return outreq
+}
+
+// Update a stored response with the headers of a 304 answering its
+// revalidation, as described in RFC 9111 section 4.3.4. The stored
+// body is kept, so its Content-Length is too.
+func refreshHeaders(stored, notModified *http.Response) {
+    for k, vv := range notModified.Header {
+        if k == "Content-Length" {
+            continue
+        }
+        stored.Header[k] = vv
+    }
+}
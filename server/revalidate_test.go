@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Revalidation", func() {
+
+	var (
+		origin  *httptest.Server
+		lc      *LocationConfig
+		etag    string
+		hits    int
+		asked   []http.Header
+	)
+
+	BeforeEach(func() {
+		etag, hits, asked = `"v1"`, 0, nil
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			asked = append(asked, r.Header.Clone())
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", 60 * hits))
+			w.Header().Set("X-Hit", fmt.Sprint(hits))
+			w.Header().Set("Etag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "response %d", hits)
+		}))
+		lc = testLocation(origin.URL, nil)
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	expire := func() {
+		Expect(cache.SetExpires("GET example.com/a", time.Now().Add(-time.Second))).To(BeTrue())
+	}
+
+	It("refreshes an expired copy the origin answers 304 for", func() {
+		_, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("MISS"))
+		expire()
+
+		r, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("REVALIDATED"))
+		Expect(asked[1].Get("If-None-Match")).To(Equal(`"v1"`))
+		Expect(r.Code).To(Equal(http.StatusOK))
+		Expect(r.Body.String()).To(Equal("response 1"))
+		Expect(r.Header().Get("X-Hit")).To(Equal("2"))
+
+		e, _ := cache.Peek("GET example.com/a")
+		Expect(time.Until(e.Expires).Seconds()).To(BeNumerically("~", 120, 2))
+		r, status = serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Body.String()).To(Equal("response 1"))
+		Expect(r.Header().Get("X-Hit")).To(Equal("2"))
+		Expect(hits).To(Equal(2))
+	})
+
+	It("replaces an expired copy that changed", func() {
+		serve(lc, "GET", "/a")
+		expire()
+		etag = `"v2"`
+
+		r, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(r.Body.String()).To(Equal("response 2"))
+		r, status = serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Body.String()).To(Equal("response 2"))
+		Expect(r.Header().Get("Etag")).To(Equal(`"v2"`))
+	})
+
+	It("keeps the client's own validators from the origin when filling the cache", func() {
+		r := serve(lc, "GET", "/a", "If-None-Match", `"v1"`)
+		Expect(asked[0].Get("If-None-Match")).To(BeEmpty())
+		Expect(r.Code).To(Equal(http.StatusNotModified))
+		Expect(serve(lc, "GET", "/a").Body.String()).To(Equal("response 1"))
+	})
+})
@@ -0,0 +1,17 @@
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"log"
+	"testing"
+	"io/ioutil"
+)
+
+func TestServer(t *testing.T) {
+	// requests the specs make aren't logged anywhere
+	accessLogger = []*AccessLogger{{Logger: log.New(ioutil.Discard, "", 0)}}
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Server Suite")
+}
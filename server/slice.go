@@ -0,0 +1,236 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "net/http"
+)
+
+// At locations with slice_size set, objects requested with a Range
+// header are cached in slices of that many bytes, each fetched from
+// the origin with a Range request of its own. Partial reads of very
+// large objects then only pull the slices they cover. Slices are
+// stored under the object's key followed by #slice=N.
+
+var errNoSlices = errors.New("origin did not answer with a partial response")
+
+func sliceKey(key string, n int64) string {
+    return key + "#slice=" + strconv.FormatInt(n, 10)
+}
+
+// A single range of the form bytes=first-last or bytes=first-,
+// last is -1 when open ended. Suffix ranges and multiple ranges
+// need the size of the object up front, so aren't handled.
+func parseSliceRange(h string) (first, last int64, ok bool) {
+    if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+        return 0, 0, false
+    }
+    spec := strings.TrimSpace(h[len("bytes="):])
+    i := strings.Index(spec, "-")
+    if i <= 0 {
+        return 0, 0, false
+    }
+    first, err := strconv.ParseInt(spec[:i], 10, 64)
+    if err != nil || first < 0 {
+        return 0, 0, false
+    }
+    last = -1
+    if s := spec[i + 1:]; s != "" {
+        if last, err = strconv.ParseInt(s, 10, 64); err != nil || last < first {
+            return 0, 0, false
+        }
+    }
+    return first, last, true
+}
+
+// complete length from a Content-Range of the form bytes first-last/total
+func contentRangeTotal(h string) (int64, bool) {
+    i := strings.LastIndex(h, "/")
+    if i < 0 {
+        return 0, false
+    }
+    total, err := strconv.ParseInt(h[i + 1:], 10, 64)
+    return total, err == nil
+}
+
+// Fetch slice n of the object under key from the origin. When t is
+// set it's cached if possible and passed on to requests waiting on t.
+// An origin that ignores the range sends the whole object, which is
+// then cached under key as if it had been fetched without slicing.
+func (p proxyHandler) fetchSlice(req *http.Request, key string, n int64, t *Target) (b []byte, err error) {
+    size := p.Config.SliceSize
+    outreq := cacheFillRequest(req, nil)
+    outreq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", n * size, (n + 1) * size - 1))
+
+    resp, _, err := proxy(p.Config, outreq)
+    if err != nil {
+        if t != nil {
+            t.Finish(err)
+        }
+        return
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        if t != nil {
+            t.Finish(err)
+        }
+        return
+    }
+    b = serializeResponse(resp, body)
+    if t == nil {
+        return
+    }
+    if b != nil && resp.StatusCode == http.StatusPartialContent && cacheableResponse(req, resp) {
+        if ttl := p.Config.cacheTTL(resp); ttl > 0 {
+            cache.Set(sliceKey(key, n), p.Config.newEntry(req, resp, b, ttl).linkKey(key))
+            t.Complete(resp, body)
+            return
+        }
+    }
+    if b != nil && resp.StatusCode == http.StatusOK {
+        max := p.Config.MaxObjectSize
+        if ttl, ok := p.storable(req, resp); ok && (max == 0 || int64(len(body)) <= max) {
+            p.store(req, resp, key, b, ttl)
+            t.Complete(resp, body)
+            return
+        }
+    }
+    t.Finish(errNotShared)
+    return
+}
+
+// Get slice n of an object from the cache, or from the origin when
+// it isn't cached. Concurrent requests for a slice are collapsed.
+// When the origin sent the whole object instead, it's returned
+// along with errNoSlices.
+func (p proxyHandler) getSlice(req *http.Request, key string, n int64) (resp *http.Response, body []byte, status string, err error) {
+    k := sliceKey(key, n)
+    e, status := cache.Get(k)
+
+    if status == "MISS" || status == "EXPIRED" {
+        t, leader := p.Config.ActiveRequests.Start(k)
+        if !leader {
+            if resp, err = t.Wait(p.Config.collapseTimeout()); err == nil {
+                status = "COLLAPSED"
+            } else if err != errNotShared && err != errCollapseTimeout {
+                return
+            }
+            t, err = nil, nil
+        }
+        if resp == nil {
+            var b []byte
+            if b, err = p.fetchSlice(req, key, n, t); err != nil {
+                return
+            }
+            resp, err = readCachedResponse(b, req)
+        }
+    } else {
+        resp, err = readCachedResponse(e.Response, req)
+    }
+    if err != nil {
+        return
+    }
+
+    switch resp.StatusCode {
+    case http.StatusPartialContent:
+        body, err = ioutil.ReadAll(resp.Body)
+    case http.StatusOK:
+        if body, err = ioutil.ReadAll(resp.Body); err == nil {
+            err = errNoSlices
+        }
+    default:
+        return nil, nil, status, errNoSlices
+    }
+    return
+}
+
+// Answer a single range request from the slices of an object.
+// Returns false without writing anything when the request has
+// to take the normal path instead, such as when the origin
+// doesn't support ranges or If-Range no longer matches.
+func (p proxyHandler) serveSlices(rw http.ResponseWriter, req *http.Request, key string, l *AccessLog) bool {
+    first, last, ok := parseSliceRange(req.Header.Get("Range"))
+    if !ok {
+        return false
+    }
+    // the whole object is cached, from an origin that ignored ranges
+    if e, _ := cache.Peek(key); e != nil {
+        return false
+    }
+    size := p.Config.SliceSize
+    n := first / size
+
+    resp, body, status, err := p.getSlice(req, key, n)
+    if err == errNoSlices && resp != nil {
+        // serve the range from the whole object rather than
+        // fetching it again
+        resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+        p.Config.stripTags(resp.Header)
+        l.CacheStatus = status
+        serveResponse(rw, req, resp, l)
+        return true
+    }
+    if err != nil {
+        if err != errNoSlices {
+            log.Println("Error fetching slice of", key + ":", err)
+        }
+        return false
+    }
+    total, ok := contentRangeTotal(resp.Header.Get("Content-Range"))
+    if !ok || first >= total {
+        return false
+    }
+    if ir := req.Header.Get("If-Range"); ir != "" && !ifRangeMatches(ir, resp) {
+        return false
+    }
+    if last < 0 || last >= total {
+        last = total - 1
+    }
+
+    copyHeader(rw.Header(), resp.Header)
+    p.Config.stripTags(rw.Header())
+    rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, total))
+    rw.Header().Set("Content-Length", strconv.FormatInt(last - first + 1, 10))
+    rw.WriteHeader(http.StatusPartialContent)
+
+    etag := resp.Header.Get("Etag")
+    for {
+        start := n * size
+        lo, hi := first - start, last - start + 1
+        if lo < 0 {
+            lo = 0
+        }
+        if hi > int64(len(body)) {
+            hi = int64(len(body))
+        }
+        if lo < hi {
+            rw.Write(body[lo:hi])
+        }
+        n++
+        if n * size > last {
+            break
+        }
+
+        // the object changing between slices can't be
+        // recovered from once the headers have been sent
+        r, b, _, err := p.getSlice(req, key, n)
+        if err != nil || r.Header.Get("Etag") != etag {
+            log.Println("Unable to complete sliced response for", key, err)
+            cache.PurgePrefix(key + "#slice=")
+            break
+        }
+        body = b
+    }
+
+    l.CacheStatus = status
+    resp.StatusCode = http.StatusPartialContent
+    resp.ContentLength = last - first + 1
+    l.ParseResp(resp)
+    return true
+}
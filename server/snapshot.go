@@ -0,0 +1,157 @@
+package server
+
+import (
+    "os"
+    "io"
+    "time"
+    "bufio"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "compress/gzip"
+    "encoding/json"
+)
+
+// admin commands for moving the contents of the cache between hosts
+func registerSnapshotCommands() {
+    cmds["snapshot"] = &Command{
+        "snapshot",
+        "Save the cache to or load it from a file: snapshot export|import <path>",
+        []string{},
+        map[string]*Command{
+            "export": subcommand("snapshot", "export", "<path>", 1, withCache(func(args []string) (string, error) {
+                path := strings.Join(args, " ")
+                n, err := exportSnapshot(path)
+                if err != nil {
+                    return "", err
+                }
+                return "Exported " + strconv.Itoa(n) + " objects to " + path + ".", nil
+            })),
+            "import": subcommand("snapshot", "import", "<path>", 1, withCache(func(args []string) (string, error) {
+                path := strings.Join(args, " ")
+                n, skipped, err := importSnapshot(path)
+                if err != nil {
+                    return "", err
+                }
+                return "Imported " + strconv.Itoa(n) + " objects, skipped " + strconv.Itoa(skipped) + ".", nil
+            })),
+        },
+        func(context []string) (reply string, err error) {
+            return runSubcommand("snapshot", context)
+        },
+    }
+}
+
+// Write every entry to a gzipped file. Each is written the way the
+// disk cache stores it, a JSON header line followed by the response,
+// with its expiry as a point in time so it keeps its remaining TTL.
+func exportSnapshot(path string) (int, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return 0, err
+    }
+    zw := gzip.NewWriter(f)
+    bw := bufio.NewWriter(zw)
+
+    n := 0
+    for _, key := range cache.Keys(func(string) bool { return true }, 0) {
+        e, _ := cache.Peek(key)
+        if e == nil {
+            continue
+        }
+        line, err := json.Marshal(newDiskHeader(key, e))
+        if err != nil {
+            f.Close()
+            return n, err
+        }
+        bw.Write(line)
+        bw.WriteByte('\n')
+        bw.Write(e.Response)
+        n++
+    }
+
+    if err = bw.Flush(); err == nil {
+        err = zw.Close()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    return n, err
+}
+
+// Load the entries in a snapshot file, skipping those that are no
+// longer of use and those this host wouldn't have cached
+func importSnapshot(path string) (n, skipped int, err error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return
+    }
+    defer f.Close()
+    zr, err := gzip.NewReader(f)
+    if err != nil {
+        return
+    }
+    br := bufio.NewReader(zr)
+
+    for {
+        line, rerr := br.ReadBytes('\n')
+        if rerr == io.EOF && len(line) == 0 {
+            return
+        }
+        if rerr != nil {
+            return n, skipped, rerr
+        }
+        var h diskHeader
+        if err = json.Unmarshal(line, &h); err != nil {
+            return
+        }
+        e := h.entry()
+        e.Response = make([]byte, h.Length)
+        if _, err = io.ReadFull(br, e.Response); err != nil {
+            return
+        }
+
+        if key, ok := importKey(h.Key, e); ok {
+            cache.Set(key, e)
+            n++
+        } else {
+            skipped++
+        }
+    }
+}
+
+// The key an imported entry is stored under, the one it was exported
+// with, since keys built from cookies or request headers can't be
+// rebuilt from the entry. ok is false if the entry is expired for good
+// or wouldn't have been cached by the location that would serve it.
+func importKey(key string, e *Entry) (string, bool) {
+    if e.Host == "" || e.URL == "" || e.staleUntil().Before(time.Now()) {
+        return "", false
+    }
+    u, err := url.ParseRequestURI(e.URL)
+    if err != nil {
+        return "", false
+    }
+    lc := findLocation(e.Host, u.Path)
+    if lc == nil || lc.ByPass {
+        return "", false
+    }
+    if lc.MaxObjectSize > 0 && int64(len(e.Response)) > lc.MaxObjectSize {
+        return "", false
+    }
+
+    req := &http.Request{
+        Method: "GET",
+        Host: e.Host,
+        URL: u,
+        Header: make(http.Header),
+    }
+    if _, ok := parseVaryMarker(e.Response); !ok {
+        resp, err := readCachedResponse(e.Response, req)
+        if err != nil || !cacheableResponse(req, resp) {
+            return "", false
+        }
+    }
+    return key, true
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"os"
+	"sort"
+	"time"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshots", func() {
+
+	var (
+		origin  *httptest.Server
+		lc      *LocationConfig
+		path    string
+		hosts   map[string]*vHost
+	)
+
+	keys := func() []string {
+		k := cache.Keys(func(string) bool { return true }, 0)
+		sort.Strings(k)
+		return k
+	}
+
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Surrogate-Key", "page" + r.URL.Path)
+			if r.URL.Path == "/v" {
+				w.Header().Set("Vary", "Accept-Language")
+			}
+			w.Write([]byte(r.URL.Path + " " + r.Header.Get("Accept-Language")))
+		}))
+		lc = testLocation(origin.URL, nil)
+		hosts = vHosts
+		vHosts = map[string]*vHost{"example.com": {Location: map[string]*LocationConfig{"/": lc}}}
+		dir, err := ioutil.TempDir("", "snapshot")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "cache.gz")
+	})
+
+	AfterEach(func() {
+		vHosts = hosts
+		origin.Close()
+		os.RemoveAll(filepath.Dir(path))
+	})
+
+	It("restores what was exported into an empty cache", func() {
+		serve(lc, "GET", "/a")
+		serve(lc, "GET", "/b")
+		serve(lc, "GET", "/v", "Accept-Language", "en")
+		serve(lc, "GET", "/v", "Accept-Language", "fr")
+		exported := keys()
+		Expect(exported).To(HaveLen(5))
+
+		n, err := exportSnapshot(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(5))
+
+		cache = NewCache(1 << 20)
+		n, skipped, err := importSnapshot(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(5))
+		Expect(skipped).To(BeZero())
+		Expect(keys()).To(Equal(exported))
+
+		origin.Close()
+		for _, lang := range []string{"en", "fr"} {
+			r, status := serveStatus(lc, "GET", "/v", "Accept-Language", lang)
+			Expect(status).To(Equal("HIT"))
+			Expect(r.Body.String()).To(Equal("/v " + lang))
+		}
+		r, status := serveStatus(lc, "GET", "/a")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Header().Get("Surrogate-Key")).To(BeEmpty())
+
+		// tags come along with the entries
+		Expect(cache.PurgeTags([]string{"page/a"}, false)).To(Equal(1))
+		e, _ := cache.Peek("GET example.com/a")
+		Expect(e).To(BeNil())
+		e, _ = cache.Peek("GET example.com/b")
+		Expect(e).NotTo(BeNil())
+	})
+
+	It("skips entries this host wouldn't serve", func() {
+		serve(lc, "GET", "/a")
+		serve(lc, "GET", "/b")
+		Expect(cache.SetExpires("GET example.com/b", time.Now().Add(-time.Minute))).To(BeTrue())
+		_, err := exportSnapshot(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		cache = NewCache(1 << 20)
+		n, skipped, err := importSnapshot(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(1))
+		Expect(skipped).To(Equal(1))
+		Expect(keys()).To(Equal([]string{"GET example.com/a"}))
+
+		cache = NewCache(1 << 20)
+		lc.ByPass = true
+		n, skipped, err = importSnapshot(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeZero())
+		Expect(skipped).To(Equal(2))
+	})
+})
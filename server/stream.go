@@ -0,0 +1,248 @@
+package server
+
+import (
+    "io"
+    "log"
+    "time"
+    "bytes"
+    "io/ioutil"
+    "net/http"
+)
+
+// size of the reads from the origin while streaming a body
+const streamBufferSize = 32 * 1024
+
+// Serialize a response the way it is kept in the cache. The body
+// has been read by then, so it is framed by its Content-Length.
+func serializeResponse(resp *http.Response, body []byte) []byte {
+    r := new(http.Response)
+    *r = *resp
+    r.Body = ioutil.NopCloser(bytes.NewReader(body))
+    r.ContentLength = int64(len(body))
+    r.TransferEncoding = nil
+
+    var buf bytes.Buffer
+    if err := r.Write(&buf); err != nil {
+        log.Println("Error serializing response:", err)
+        return nil
+    }
+    return buf.Bytes()
+}
+
+// Copy a response body to the client while keeping a copy of it for
+// the cache. The copy is abandoned once it grows past max bytes (if
+// max is set), and the client keeps receiving the body. If writing to
+// the client fails the body is still read to the end for the cache.
+// When share is set the copy is kept in it, for collapsed requests to
+// read as it arrives, and abandoning the copy finishes share as not
+// shared. kept is nil unless the whole body was kept.
+func copyBody(w io.Writer, share *Target, body io.Reader, keep bool, max int64) (kept []byte, written int64, err error) {
+    var buf *bytes.Buffer
+    if keep && share == nil {
+        buf = new(bytes.Buffer)
+    }
+    flusher, _ := w.(http.Flusher)
+
+    var size int64
+    p := make([]byte, streamBufferSize)
+    for {
+        n, rerr := body.Read(p)
+        if n > 0 {
+            size += int64(n)
+            if max > 0 && size > max {
+                buf = nil
+                if share != nil {
+                    share.Finish(errNotShared)
+                    share = nil
+                }
+            }
+            if buf != nil {
+                buf.Write(p[:n])
+            }
+            if share != nil {
+                if _, err := share.Write(p[:n]); err != nil {
+                    share = nil
+                }
+            }
+            if w != nil {
+                m, werr := w.Write(p[:n])
+                written += int64(m)
+                if werr != nil {
+                    w = nil
+                } else if flusher != nil {
+                    flusher.Flush()
+                }
+            }
+            if w == nil && buf == nil && share == nil {
+                return nil, written, nil
+            }
+        }
+        if rerr == io.EOF {
+            break
+        }
+        if rerr != nil {
+            return nil, written, rerr
+        }
+    }
+    if share != nil {
+        return share.Body(), written, nil
+    }
+    if buf == nil {
+        return nil, written, nil
+    }
+    return buf.Bytes(), written, nil
+}
+
+// Send the request to the origin. When fill is set the request is
+// made to fill the cache, revalidating the expired copy if there is
+// one. If the origin answers that with 304, the refreshed copy is
+// returned in its place and revalidated is true.
+func (p proxyHandler) originRequest(req *http.Request, fill bool, expired []byte, l *AccessLog) (resp *http.Response, revalidated bool, err error) {
+    outreq := req
+    var old *http.Response
+    if fill {
+        if expired != nil {
+            if old, err = readCachedResponse(expired, req); err != nil {
+                log.Println("Unable to revalidate cached response:", err)
+                old = nil
+            }
+        }
+        outreq = cacheFillRequest(req, old)
+    }
+
+    t := time.Now()
+    resp, l.Attempts, err = proxy(p.Config, outreq)
+    if err != nil {
+        return
+    }
+    l.OriginTime = time.Since(t)
+
+    if old != nil && resp.StatusCode == http.StatusNotModified {
+        resp.Body.Close()
+        refreshHeaders(old, resp)
+        return old, true, nil
+    }
+    return resp, false, nil
+}
+
+// number of seconds a response can be cached for, ok is false if it can't be
+func (p proxyHandler) storable(req *http.Request, resp *http.Response) (ttl int, ok bool) {
+    // partial responses are only ever cached as slices
+    if resp.StatusCode == http.StatusPartialContent || !cacheableResponse(req, resp) {
+        return 0, false
+    }
+    ttl = p.Config.cacheTTL(resp)
+    return ttl, ttl > 0 || p.Config.revalidateOnly(resp)
+}
+
+// Save a serialized response under cacheKey, or under the key of
+// its variant if the response has a Vary header
+func (p proxyHandler) store(req *http.Request, resp *http.Response, cacheKey string, b []byte, ttl int) {
+    if vary := varyHeaders(resp.Header); len(vary) > 0 {
+        cache.Set(cacheKey, p.Config.newEntry(req, resp, varyMarker(vary), ttl))
+        cache.Set(variantKey(cacheKey, req, vary), p.Config.newEntry(req, resp, b, ttl).linkKey(cacheKey))
+        return
+    }
+    cache.Set(cacheKey, p.Config.newEntry(req, resp, b, ttl))
+}
+
+// Read a whole origin response and cache it if possible, for
+// requests that have no client waiting on them. The response is
+// passed on to requests collapsed on t when it was cached.
+func (p proxyHandler) fetch(req *http.Request, cacheKey string, expired []byte, t *Target) error {
+    resp, _, err := p.originRequest(req, true, expired, NewAccessLog())
+    if err != nil {
+        t.Finish(err)
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        t.Finish(err)
+        return err
+    }
+    b := serializeResponse(resp, body)
+    if ttl, ok := p.storable(req, resp); ok && b != nil {
+        p.store(req, resp, cacheKey, b, ttl)
+        t.Complete(resp, body)
+        return nil
+    }
+    t.Finish(errNotShared)
+    return nil
+}
+
+// Send an origin response to the client as it arrives. When t is set
+// the request leads others collapsed on it, and the response is also
+// cached under cacheKey if it's cacheable and no larger than
+// max_object_size. The client's conditionals and ranges are answered
+// here in that case, since they weren't sent to the origin.
+func (p proxyHandler) serveOrigin(rw http.ResponseWriter, req *http.Request, resp *http.Response, cacheKey string, t *Target, l *AccessLog) {
+    defer resp.Body.Close()
+    fill := t != nil
+    ttl, keep := 0, false
+    if fill {
+        ttl, keep = p.storable(req, resp)
+    }
+    max := p.Config.MaxObjectSize
+
+    // Waiters only follow responses they could have been served
+    // from the cache, otherwise they make their own request. The
+    // body is kept for the cache in the target they read from.
+    var share *Target
+    if keep && (resp.ContentLength < 0 || max == 0 || resp.ContentLength <= max) {
+        t.Respond(resp)
+        share = t
+    } else if fill {
+        t.Finish(errNotShared)
+    }
+
+    // what the client was sent, for the access log
+    sent := *resp
+    var client io.Writer
+    var body []byte
+    var err error
+    if code := checkConditions(req, resp); code != 0 && fill {
+        respondConditional(resp, rw, code)
+        sent.StatusCode, sent.Status = code, http.StatusText(code)
+        body, _, err = copyBody(nil, share, resp.Body, keep, max)
+    } else if fill && req.Header.Get("Range") != "" && resp.StatusCode == http.StatusOK &&
+        resp.ContentLength >= 0 && (max == 0 || resp.ContentLength <= max) {
+        // small enough to read whole and serve the range from
+        if body, _, err = copyBody(nil, share, resp.Body, true, max); err != nil {
+            rw.WriteHeader(http.StatusBadGateway)
+            sent.StatusCode, sent.Status = http.StatusBadGateway, http.StatusText(http.StatusBadGateway)
+        } else {
+            sent.Body = ioutil.NopCloser(bytes.NewReader(body))
+            sent.Header = resp.Header.Clone()
+            p.Config.stripTags(sent.Header)
+            serveRange(&sent, rw, req)
+        }
+    } else {
+        // including larger ranges, which get the whole object
+        client = rw
+        copyHeader(rw.Header(), resp.Header)
+        p.Config.stripTags(rw.Header())
+        rw.WriteHeader(resp.StatusCode)
+        body, sent.ContentLength, err = copyBody(client, share, resp.Body, keep, max)
+    }
+    l.ParseResp(&sent)
+
+    if err != nil {
+        log.Println("Error reading origin response:", err)
+        if share != nil {
+            t.Finish(err)
+        }
+        return
+    }
+    // stored before finishing, so that requests arriving
+    // once the target is gone find it in the cache
+    if keep && body != nil {
+        if b := serializeResponse(resp, body); b != nil {
+            p.store(req, resp, cacheKey, b, ttl)
+        }
+    }
+    if share != nil {
+        t.Finish(nil)
+    }
+}
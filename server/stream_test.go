@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming", func() {
+
+	var ar *ActiveRequests
+
+	BeforeEach(func() {
+		ar = &ActiveRequests{Targets: make(map[string]*Target)}
+	})
+
+	// a leader of key with one request waiting on it
+	share := func(key string) (*Target, *Target) {
+		t, _ := ar.Start(key)
+		t.Respond(&http.Response{StatusCode: http.StatusOK, Header: make(http.Header)})
+		w, leader := ar.Start(key)
+		Expect(leader).To(BeFalse())
+		return t, w
+	}
+
+	It("keeps the body for the cache in the target waiters read", func() {
+		t, w := share("k")
+		body := strings.Repeat("x", 3 * streamBufferSize)
+		var client bytes.Buffer
+		kept, written, err := copyBody(&client, t, strings.NewReader(body), true, 0)
+		Expect(err).NotTo(HaveOccurred())
+		t.Finish(nil)
+
+		Expect(written).To(BeNumerically("==", len(body)))
+		Expect(client.String()).To(Equal(body))
+		Expect(string(kept)).To(Equal(body))
+		Expect(&kept[0]).To(BeIdenticalTo(&t.Body()[0]))
+
+		resp, err := w.Wait(0)
+		Expect(err).NotTo(HaveOccurred())
+		b, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(b)).To(Equal(body))
+	})
+
+	It("stops keeping and sharing a body past max", func() {
+		t, w := share("k")
+		body := strings.Repeat("x", 3 * streamBufferSize)
+		var client bytes.Buffer
+		kept, _, err := copyBody(&client, t, strings.NewReader(body), true, 2 * streamBufferSize)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kept).To(BeNil())
+		Expect(client.String()).To(Equal(body))
+
+		resp, err := w.Wait(0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ioutil.ReadAll(resp.Body)
+		Expect(err).To(Equal(errNotShared))
+	})
+
+	It("streams objects over max_object_size to the client without caching them", func() {
+		var hits int32
+		size := 3 * streamBufferSize
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			n := size
+			if r.URL.Path == "/small" {
+				n = streamBufferSize
+			}
+			w.Write(bytes.Repeat([]byte("x"), n))
+		}))
+		defer origin.Close()
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.MaxObjectSize = int64(2 * streamBufferSize)
+		})
+
+		for i := 0; i < 2; i++ {
+			r, status := serveStatus(lc, "GET", "/large")
+			Expect(status).To(Equal("MISS"))
+			Expect(r.Code).To(Equal(http.StatusOK))
+			Expect(r.Body.Len()).To(Equal(size))
+		}
+		Expect(atomic.LoadInt32(&hits)).To(BeNumerically("==", 2))
+		e, _ := cache.Peek("GET example.com/large")
+		Expect(e).To(BeNil())
+
+		serve(lc, "GET", "/small")
+		r, status := serveStatus(lc, "GET", "/small")
+		Expect(status).To(Equal("HIT"))
+		Expect(r.Body.Len()).To(Equal(streamBufferSize))
+	})
+})
@@ -0,0 +1,137 @@
+package server
+
+import (
+    "sync"
+    "strings"
+    "net/http"
+)
+
+// origin response headers tags are read from
+// when the location doesn't set tag_headers
+var defaultTagHeaders = []string{
+    "Surrogate-Key",
+    "Cache-Tag",
+}
+
+func (lc *LocationConfig) tagHeaders() []string {
+    if lc.TagHeaders != nil {
+        return lc.TagHeaders
+    }
+    return defaultTagHeaders
+}
+
+// Tags the origin gave a response, from space or comma separated
+// lists in any of the location's tag headers. The headers stay in
+// the cached copy so the tags are kept when it's revalidated.
+func (lc *LocationConfig) responseTags(resp *http.Response) []string {
+    var tags []string
+    for _, name := range lc.tagHeaders() {
+        for _, v := range resp.Header.Values(name) {
+            tags = append(tags, strings.FieldsFunc(v, func(r rune) bool {
+                return r == ' ' || r == ',' || r == '\t'
+            })...)
+        }
+    }
+    return tags
+}
+
+// tags are for the cache only, clients never see them
+func (lc *LocationConfig) stripTags(h http.Header) {
+    for _, name := range lc.tagHeaders() {
+        h.Del(name)
+    }
+}
+
+// Tag linking the variants and slices stored for a cache key to it,
+// so purging the key finds them through the tag index rather than by
+// scanning. Tags from origin headers never hold a space, unlike it.
+func keyTag(key string) string {
+    return "#key " + key
+}
+
+// tag an entry stored under a key derived from key
+func (e *Entry) linkKey(key string) *Entry {
+    e.Tags = append(e.Tags, keyTag(key))
+    return e
+}
+
+// the tags the origin gave the entry
+func (e *Entry) originTags() []string {
+    tags := make([]string, 0, len(e.Tags))
+    for _, t := range e.Tags {
+        if !strings.HasPrefix(t, "#key ") {
+            tags = append(tags, t)
+        }
+    }
+    return tags
+}
+
+// whether the entry has any of the tags
+func (e *Entry) hasTag(tags []string) bool {
+    for _, t := range e.Tags {
+        for _, tag := range tags {
+            if t == tag {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Keys of the cached entries with each tag, kept by the
+// backends so purging a tag doesn't scan the whole cache
+type tagIndex struct {
+    lock        sync.Mutex
+    keys        map[string]map[string]bool
+}
+
+func newTagIndex() *tagIndex {
+    return &tagIndex{
+        keys: make(map[string]map[string]bool),
+    }
+}
+
+func (ti *tagIndex) add(key string, tags []string) {
+    if len(tags) == 0 {
+        return
+    }
+    ti.lock.Lock()
+    defer ti.lock.Unlock()
+    for _, tag := range tags {
+        if ti.keys[tag] == nil {
+            ti.keys[tag] = make(map[string]bool)
+        }
+        ti.keys[tag][key] = true
+    }
+}
+
+func (ti *tagIndex) remove(key string, tags []string) {
+    if len(tags) == 0 {
+        return
+    }
+    ti.lock.Lock()
+    defer ti.lock.Unlock()
+    for _, tag := range tags {
+        delete(ti.keys[tag], key)
+        if len(ti.keys[tag]) == 0 {
+            delete(ti.keys, tag)
+        }
+    }
+}
+
+// keys with any of the tags, each listed once
+func (ti *tagIndex) lookup(tags []string) []string {
+    ti.lock.Lock()
+    defer ti.lock.Unlock()
+    seen := make(map[string]bool)
+    keys := make([]string, 0)
+    for _, tag := range tags {
+        for key := range ti.keys[tag] {
+            if !seen[key] {
+                seen[key] = true
+                keys = append(keys, key)
+            }
+        }
+    }
+    return keys
+}
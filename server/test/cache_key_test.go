@@ -0,0 +1,39 @@
+package daemon_test
+
+import (
+	"net/http"
+	. ".."
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache key", func() {
+
+	request := func() *http.Request {
+		r, _ := http.NewRequest("GET", "/p?utm_source=x&b=2&a=1&utm_medium=y", nil)
+		r.Host = "Example.COM:80"
+		r.Header.Set("Cookie", "sess=abc")
+		r.Header.Set("X-Device", "mobile")
+		return r
+	}
+
+	It("substitutes variables", func() {
+		lc := &LocationConfig{CacheKey: "$method $scheme://$host$uri?$querystring $cookie_sess $http_x_device $unknown"}
+		Expect(lc.GetCacheKey(request())).To(Equal(
+			"GET http://Example.COM:80/p?utm_source=x&b=2&a=1&utm_medium=y abc mobile $unknown"))
+	})
+
+	It("normalizes the host and query", func() {
+		lc := &LocationConfig{
+			CacheKey: "$host$uri?$querystring",
+			KeySortQuery: true,
+			KeyQueryExclude: []string{"utm_*"},
+			KeyLowercaseHost: true,
+			KeyStripDefaultPort: true,
+		}
+		Expect(lc.GetCacheKey(request())).To(Equal("example.com/p?a=1&b=2"))
+
+		lc.KeyQueryInclude = []string{"b"}
+		Expect(lc.GetCacheKey(request())).To(Equal("example.com/p?b=2"))
+	})
+})
@@ -0,0 +1,238 @@
+package daemon_test
+
+import (
+	"sync"
+	"time"
+	"strconv"
+	"testing"
+	. ".."
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+
+	It("returns MISS, HIT and EXPIRED", func() {
+		c := NewCache(1 << 20)
+		_, status := c.Get("a")
+		Expect(status).To(Equal("MISS"))
+
+		c.Set("a", NewEntry([]byte("hello"), 60))
+		e, status := c.Get("a")
+		Expect(status).To(Equal("HIT"))
+		Expect(string(e.Response)).To(Equal("hello"))
+
+		c.Set("b", NewEntry([]byte("bye"), -1))
+		_, status = c.Get("b")
+		Expect(status).To(Equal("EXPIRED"))
+	})
+
+	It("stays within its byte budget", func() {
+		c := NewCache(512 * 1024)
+		body := make([]byte, 1024)
+		for i := 0; i < 1000; i++ {
+			c.Set(strconv.Itoa(i), NewEntry(body, 60))
+		}
+		st := c.Stats()
+		Expect(st.Bytes).To(BeNumerically("<=", c.MaxSize))
+		Expect(st.Evictions).To(BeNumerically(">", 0))
+		Expect(st.Entries + st.Evictions).To(BeNumerically("==", 1000))
+	})
+
+	It("rejects objects larger than the cache", func() {
+		c := NewCache(1024)
+		c.Set("big", NewEntry(make([]byte, 4096), 60))
+		_, status := c.Get("big")
+		Expect(status).To(Equal("MISS"))
+		Expect(c.Stats().Rejected).To(BeNumerically("==", 1))
+	})
+
+	It("purges expired objects", func() {
+		c := NewCache(1 << 20)
+		c.Set("old", NewEntry([]byte("x"), -1))
+		c.Set("new", NewEntry([]byte("x"), 60))
+		stale := NewEntry([]byte("x"), -1)
+		stale.StaleIfError = time.Minute
+		c.Set("stale", stale)
+		c.PurgeExpired()
+		_, status := c.Get("old")
+		Expect(status).To(Equal("MISS"))
+		_, status = c.Get("new")
+		Expect(status).To(Equal("HIT"))
+		_, status = c.Get("stale")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(c.Stats().Expired).To(BeNumerically("==", 1))
+	})
+
+	It("purges objects by tag", func() {
+		c := NewCache(1 << 20)
+		a := NewEntry([]byte("a"), 60)
+		a.Tags = []string{"article-1", "home"}
+		b := NewEntry([]byte("b"), 60)
+		b.Tags = []string{"article-2"}
+		c.Set("a", a)
+		c.Set("b", b)
+		c.Set("c", NewEntry([]byte("c"), 60))
+		Expect(c.PurgeTags([]string{"article-1", "missing"}, false)).To(Equal(1))
+		_, status := c.Get("a")
+		Expect(status).To(Equal("MISS"))
+		_, status = c.Get("b")
+		Expect(status).To(Equal("HIT"))
+
+		// replaced without the tag
+		c.Set("b", NewEntry([]byte("b"), 60))
+		Expect(c.PurgeTags([]string{"article-2"}, false)).To(Equal(0))
+	})
+
+	It("soft purges by expiring objects", func() {
+		c := NewCache(1 << 20)
+		c.Set("GET example.com/a", NewEntry([]byte("a"), 60))
+		c.Set("GET example.com/b", NewEntry([]byte("b"), 60))
+		match := func(key string, e *Entry) bool {
+			return key == "GET example.com/a"
+		}
+		Expect(c.PurgeMatch(match, true)).To(Equal(1))
+		e, status := c.Get("GET example.com/a")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(string(e.Response)).To(Equal("a"))
+
+		Expect(c.PurgeMatch(match, false)).To(Equal(1))
+		_, status = c.Get("GET example.com/a")
+		Expect(status).To(Equal("MISS"))
+		_, status = c.Get("GET example.com/b")
+		Expect(status).To(Equal("HIT"))
+	})
+
+	It("can be inspected", func() {
+		c := NewCache(1 << 20)
+		c.Set("GET example.com/a", NewEntry([]byte("a"), 60))
+		c.Set("GET example.com/b", NewEntry([]byte("b"), 60))
+		c.Get("GET example.com/a")
+		c.Get("GET example.com/a")
+		c.Get("GET example.com/c")
+
+		e, hits := c.Peek("GET example.com/a")
+		Expect(string(e.Response)).To(Equal("a"))
+		Expect(hits).To(BeNumerically("==", 2))
+		st := c.Stats()
+		Expect(st.Hits).To(BeNumerically("==", 2))
+		Expect(st.Misses).To(BeNumerically("==", 1))
+
+		keys := c.Keys(func(key string) bool { return true }, 1)
+		Expect(keys).To(HaveLen(1))
+
+		Expect(c.SetExpires("GET example.com/b", time.Now().Add(-time.Second))).To(BeTrue())
+		_, status := c.Get("GET example.com/b")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(c.SetExpires("GET example.com/c", time.Now())).To(BeFalse())
+	})
+
+	// meant to be run with -race
+	It("is safe for concurrent readers, writers and cleaners", func() {
+		c := NewCache(256 * 1024)
+		body := make([]byte, 512)
+		done := make(chan bool)
+		var wg sync.WaitGroup
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					c.PurgeExpired()
+					c.Stats()
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					key := strconv.Itoa((g * i) % 700)
+					if i % 3 == 0 {
+						c.Set(key, NewEntry(body, i % 5 - 1))
+					} else {
+						c.Get(key)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(done)
+		Expect(c.Stats().Bytes).To(BeNumerically("<=", c.MaxSize))
+	})
+})
+
+// The cache as it was before sharding, with the single
+// lock it would have needed to be used concurrently.
+type mapCache struct {
+	lock sync.Mutex
+	data map[string][]byte
+}
+
+func (m *mapCache) Get(key string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.data[key]
+}
+
+func (m *mapCache) Set(key string, b []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data[key] = b
+}
+
+var benchKeys = func() []string {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "GET example.com/asset/" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+func BenchmarkCacheParallel(b *testing.B) {
+	c := NewCache(64 << 20)
+	e := NewEntry(make([]byte, 1024), 60)
+	for _, k := range benchKeys {
+		c.Set(k, e)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := benchKeys[i % len(benchKeys)]
+			if i % 10 == 0 {
+				c.Set(k, e)
+			} else {
+				c.Get(k)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMapCacheParallel(b *testing.B) {
+	c := &mapCache{data: make(map[string][]byte)}
+	body := make([]byte, 1024)
+	for _, k := range benchKeys {
+		c.Set(k, body)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := benchKeys[i % len(benchKeys)]
+			if i % 10 == 0 {
+				c.Set(k, body)
+			} else {
+				c.Get(k)
+			}
+			i++
+		}
+	})
+}
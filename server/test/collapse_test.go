@@ -0,0 +1,143 @@
+package daemon_test
+
+import (
+	"sync"
+	"time"
+	"errors"
+	"net/http"
+	"io/ioutil"
+	. ".."
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ActiveRequests", func() {
+
+	var ar *ActiveRequests
+
+	BeforeEach(func() {
+		ar = &ActiveRequests{Targets: make(map[string]*Target)}
+	})
+
+	response := func() *http.Response {
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Header:     http.Header{"Etag": {`"a"`}},
+		}
+	}
+
+	// start n requests waiting on key, each sending what
+	// it read or the error it got on results
+	wait := func(key string, n int, d time.Duration) (*sync.WaitGroup, chan interface{}) {
+		results := make(chan interface{}, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			t, leader := ar.Start(key)
+			Expect(leader).To(BeFalse())
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				resp, err := t.Wait(d)
+				if err != nil {
+					results <- err
+					return
+				}
+				resp.Header.Set("Etag", `"changed"`)
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					results <- err
+					return
+				}
+				results <- string(b)
+			}()
+		}
+		return &wg, results
+	}
+
+	It("streams the leader's response to every waiter", func() {
+		t, leader := ar.Start("k")
+		Expect(leader).To(BeTrue())
+		Expect(ar.TryStart("k")).To(BeNil())
+
+		wg, results := wait("k", 5, time.Second)
+		resp := response()
+		t.Respond(resp)
+		t.Write([]byte("hello "))
+		time.Sleep(10 * time.Millisecond)
+		t.Write([]byte("world"))
+		t.Finish(nil)
+		wg.Wait()
+		close(results)
+
+		for r := range results {
+			Expect(r).To(Equal("hello world"))
+		}
+		Expect(resp.Header.Get("Etag")).To(Equal(`"a"`))
+
+		_, leader = ar.Start("k")
+		Expect(leader).To(BeTrue())
+	})
+
+	It("passes the leader's error on to waiters", func() {
+		t, _ := ar.Start("k")
+		wg, results := wait("k", 3, time.Second)
+		t.Respond(response())
+		t.Write([]byte("part"))
+		t.Finish(errors.New("connection reset"))
+		t.Finish(nil)
+		wg.Wait()
+		close(results)
+
+		for r := range results {
+			Expect(r).To(MatchError("connection reset"))
+		}
+	})
+
+	It("fails waiters with errNotShared when the response isn't shared", func() {
+		t, _ := ar.Start("k")
+		wg, results := wait("k", 3, time.Second)
+		t.Finish(nil)
+		wg.Wait()
+		close(results)
+
+		for r := range results {
+			Expect(r).To(MatchError("response is not shared"))
+		}
+	})
+
+	It("stops sharing a body larger than its size limit", func() {
+		ar.MaxSize = 8
+		t, _ := ar.Start("k")
+		wg, results := wait("k", 3, time.Second)
+		t.Respond(response())
+		_, err := t.Write([]byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = t.Write([]byte("world"))
+		Expect(err).To(MatchError("response is not shared"))
+		t.Finish(nil)
+		wg.Wait()
+		close(results)
+
+		for r := range results {
+			Expect(r).To(MatchError("response is not shared"))
+		}
+		_, leader := ar.Start("k")
+		Expect(leader).To(BeTrue())
+	})
+
+	It("times out waiting for a slow leader", func() {
+		t, _ := ar.Start("k")
+		start := time.Now()
+		wg, results := wait("k", 3, 50 * time.Millisecond)
+		wg.Wait()
+		close(results)
+
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		for r := range results {
+			Expect(r).To(MatchError("timed out waiting for collapsed request"))
+		}
+		t.Finish(nil)
+	})
+})
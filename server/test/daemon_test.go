@@ -1,9 +1,7 @@
 package daemon_test
 
 import (
-	. "UNKOWN_PACKAGE_PATH"
 	. "github.com/onsi/ginkgo"
-	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Daemon", func() {
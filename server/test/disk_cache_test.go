@@ -0,0 +1,193 @@
+package daemon_test
+
+import (
+	"os"
+	"sync"
+	"time"
+	"strconv"
+	"io/ioutil"
+	"path/filepath"
+	. ".."
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DiskCache", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pongo-disk")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	// files in the cache directory and their total size
+	files := func() (names []string, size int64) {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				names = append(names, path)
+				size += fi.Size()
+			}
+			return nil
+		})
+		return names, size
+	}
+
+	It("reloads its index on startup", func() {
+		c, err := NewDiskCache(dir, 1 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		c.Set("a", NewEntry([]byte("hello"), 60))
+		c.Set("b", NewEntry([]byte("bye"), -1))
+
+		c, err = NewDiskCache(dir, 1 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Stats().Entries).To(BeNumerically("==", 2))
+		e, status := c.Get("a")
+		Expect(status).To(Equal("HIT"))
+		Expect(string(e.Response)).To(Equal("hello"))
+		_, status = c.Get("b")
+		Expect(status).To(Equal("EXPIRED"))
+	})
+
+	It("skips partial and corrupt files on startup", func() {
+		c, _ := NewDiskCache(dir, 1 << 20)
+		c.Set("whole", NewEntry([]byte("whole"), 60))
+		c.Set("truncated", NewEntry([]byte("truncated"), 60))
+		names, _ := files()
+		Expect(names).To(HaveLen(2))
+
+		e, _ := c.Peek("truncated")
+		for _, name := range names {
+			b, _ := ioutil.ReadFile(name)
+			if string(b[len(b) - len(e.Response):]) == "truncated" {
+				Expect(os.Truncate(name, int64(len(b) - 3))).To(Succeed())
+			}
+		}
+		os.MkdirAll(filepath.Join(dir, "zz"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "zz", "corrupt"), []byte("not a header\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "zz", "partial.123.tmp"), []byte("{"), 0644)
+
+		c, err := NewDiskCache(dir, 1 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Stats().Entries).To(BeNumerically("==", 1))
+		_, status := c.Get("whole")
+		Expect(status).To(Equal("HIT"))
+		_, status = c.Get("truncated")
+		Expect(status).To(Equal("MISS"))
+		names, _ = files()
+		Expect(names).To(HaveLen(1))
+	})
+
+	It("evicts the least recently used files to stay within its size", func() {
+		c, _ := NewDiskCache(dir, 4096)
+		body := make([]byte, 1000)
+		for i := 0; i < 10; i++ {
+			c.Set(strconv.Itoa(i), NewEntry(body, 60))
+		}
+		st := c.Stats()
+		Expect(st.Bytes).To(BeNumerically("<=", 4096))
+		Expect(st.Evictions).To(BeNumerically(">", 0))
+		Expect(st.Entries + st.Evictions).To(BeNumerically("==", 10))
+		_, status := c.Get("0")
+		Expect(status).To(Equal("MISS"))
+		_, status = c.Get("9")
+		Expect(status).To(Equal("HIT"))
+
+		names, size := files()
+		Expect(names).To(HaveLen(int(st.Entries)))
+		Expect(size).To(Equal(st.Bytes))
+	})
+
+	// meant to be run with -race
+	It("keeps files and index together under concurrent writes", func() {
+		c, _ := NewDiskCache(dir, 1 << 20)
+		for round := 0; round < 200; round++ {
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					if (g + round) % 5 == 0 {
+						c.Delete("k")
+					} else {
+						c.Set("k", NewEntry(make([]byte, 4096 + g), 60))
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			st := c.Stats()
+			names, size := files()
+			Expect(names).To(HaveLen(int(st.Entries)))
+			Expect(size).To(Equal(st.Bytes))
+			if st.Entries > 0 {
+				_, status := c.Get("k")
+				Expect(status).To(Equal("HIT"))
+			}
+		}
+	})
+
+	It("keeps soft purged files across restarts", func() {
+		c, _ := NewDiskCache(dir, 1 << 20)
+		e := NewEntry([]byte("tagged"), 60)
+		e.Tags = []string{"t"}
+		c.Set("a", e)
+		c.Set("b", NewEntry([]byte("other"), 60))
+		Expect(c.PurgeTags([]string{"t"}, true)).To(Equal(1))
+
+		e, status := c.Get("a")
+		Expect(status).To(Equal("EXPIRED"))
+		Expect(string(e.Response)).To(Equal("tagged"))
+		c, _ = NewDiskCache(dir, 1 << 20)
+		_, status = c.Get("a")
+		Expect(status).To(Equal("EXPIRED"))
+		_, status = c.Get("b")
+		Expect(status).To(Equal("HIT"))
+		names, size := files()
+		Expect(names).To(HaveLen(2))
+		Expect(size).To(Equal(c.Stats().Bytes))
+	})
+
+	// meant to be run with -race
+	It("doesn't undo writes made while soft purging", func() {
+		c, _ := NewDiskCache(dir, 1 << 20)
+		for round := 0; round < 100; round++ {
+			old := NewEntry(make([]byte, 4096), 60)
+			old.Tags = []string{"t"}
+			c.Set("k", old)
+
+			var wg sync.WaitGroup
+			wg.Add(3)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				c.PurgeTags([]string{"t"}, true)
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				c.SetExpires("k", time.Now().Add(-time.Second))
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				c.Set("k", NewEntry([]byte("new"), 60))
+			}()
+			wg.Wait()
+
+			// the new entry, expired if it was purged after
+			// the write, but never the old one's body
+			e, _ := c.Get("k")
+			Expect(string(e.Response)).To(Equal("new"))
+			names, size := files()
+			Expect(names).To(HaveLen(1))
+			Expect(size).To(Equal(c.Stats().Bytes))
+		}
+	})
+})
@@ -0,0 +1,54 @@
+package daemon_test
+
+import (
+	"os"
+	"io/ioutil"
+	. ".."
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TieredCache", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pongo-tiered")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("promotes disk hits to memory", func() {
+		c, err := NewTieredCache(1 << 20, dir, 1 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		c.Disk.Set("a", NewEntry([]byte("a"), 60))
+		_, status := c.Get("a")
+		Expect(status).To(Equal("HIT-DISK"))
+		_, status = c.Get("a")
+		Expect(status).To(Equal("HIT-MEM"))
+		Expect(c.Disk.Stats().Entries).To(BeNumerically("==", 0))
+	})
+
+	It("keeps objects larger than the memory tier on disk", func() {
+		c, err := NewTieredCache(1024, dir, 1 << 20)
+		Expect(err).NotTo(HaveOccurred())
+		c.Set("big", NewEntry(make([]byte, 4096), 60))
+		for i := 0; i < 2; i++ {
+			e, status := c.Get("big")
+			Expect(status).To(Equal("HIT-DISK"))
+			Expect(e.Response).To(HaveLen(4096))
+		}
+		Expect(c.Mem.Stats().Rejected).To(BeNumerically("==", 0))
+
+		// replacing it with a small copy moves it to memory
+		c.Set("big", NewEntry([]byte("small"), 60))
+		e, status := c.Get("big")
+		Expect(status).To(Equal("HIT-MEM"))
+		Expect(string(e.Response)).To(Equal("small"))
+		Expect(c.Disk.Stats().Entries).To(BeNumerically("==", 0))
+	})
+})
@@ -0,0 +1,142 @@
+package server
+
+import (
+    "time"
+    "sync/atomic"
+)
+
+// Cache backend keeping hot objects in memory and demoting
+// whatever the memory tier evicts to disk. Disk hits are
+// promoted back to memory, unless they are too large for it,
+// in which case they are only ever kept on disk. An object
+// lives in one tier at a time, and Get reports which one
+// served it as HIT-MEM or HIT-DISK.
+type TieredCache struct {
+    Mem         *Cache
+    Disk        *DiskCache
+    hits        int64
+    misses      int64
+}
+
+func init() {
+    RegisterCacheBackend("tiered", func(cfg CacheConfig) (CacheBackend, error) {
+        return NewTieredCache(cfg.Size, cfg.Path, cfg.DiskSize)
+    })
+}
+
+func NewTieredCache(memSize int64, path string, diskSize int64) (*TieredCache, error) {
+    disk, err := NewDiskCache(path, diskSize)
+    if err != nil {
+        return nil, err
+    }
+    t := &TieredCache{
+        Mem:    NewCache(memSize),
+        Disk:   disk,
+    }
+    t.Mem.onEvict = t.demote
+    return t, nil
+}
+
+// objects that can't be served anymore aren't worth the disk write
+func (t *TieredCache) demote(key string, e *Entry) {
+    if e.staleUntil().After(time.Now()) {
+        t.Disk.Set(key, e)
+    }
+}
+
+func (t *TieredCache) Get(key string) (e *Entry, status string) {
+    e, status = t.get(key)
+    if status == "HIT-MEM" || status == "HIT-DISK" {
+        atomic.AddInt64(&t.hits, 1)
+    } else {
+        atomic.AddInt64(&t.misses, 1)
+    }
+    return
+}
+
+func (t *TieredCache) get(key string) (e *Entry, status string) {
+    if e, status = t.Mem.Get(key); status != "MISS" {
+        if status == "HIT" {
+            status = "HIT-MEM"
+        }
+        return
+    }
+
+    if e, status = t.Disk.Get(key); status == "HIT" {
+        if t.Mem.fits(key, e) {
+            t.Mem.Set(key, e)
+            t.Disk.Delete(key)
+        }
+        status = "HIT-DISK"
+    }
+    return
+}
+
+// The disk copy is only deleted once memory holds the object,
+// objects larger than the memory tier are written to disk.
+func (t *TieredCache) Set(key string, e *Entry) {
+    if !t.Mem.fits(key, e) {
+        t.Mem.Delete(key)
+        t.Disk.Set(key, e)
+        return
+    }
+    t.Mem.Set(key, e)
+    t.Disk.Delete(key)
+}
+
+func (t *TieredCache) Delete(key string) bool {
+    m := t.Mem.Delete(key)
+    d := t.Disk.Delete(key)
+    return m || d
+}
+
+func (t *TieredCache) PurgePrefix(prefix string) int {
+    return t.Mem.PurgePrefix(prefix) + t.Disk.PurgePrefix(prefix)
+}
+
+func (t *TieredCache) PurgeTags(tags []string, soft bool) int {
+    return t.Mem.PurgeTags(tags, soft) + t.Disk.PurgeTags(tags, soft)
+}
+
+func (t *TieredCache) PurgeMatch(match func(key string, e *Entry) bool, soft bool) int {
+    return t.Mem.PurgeMatch(match, soft) + t.Disk.PurgeMatch(match, soft)
+}
+
+func (t *TieredCache) Peek(key string) (*Entry, int64) {
+    if e, hits := t.Mem.Peek(key); e != nil {
+        return e, hits
+    }
+    return t.Disk.Peek(key)
+}
+
+func (t *TieredCache) Keys(match func(key string) bool, limit int) []string {
+    keys := t.Mem.Keys(match, limit)
+    if limit > 0 {
+        if limit -= len(keys); limit <= 0 {
+            return keys
+        }
+    }
+    return append(keys, t.Disk.Keys(match, limit)...)
+}
+
+func (t *TieredCache) SetExpires(key string, e time.Time) bool {
+    m := t.Mem.SetExpires(key, e)
+    d := t.Disk.SetExpires(key, e)
+    return m || d
+}
+
+// totals across both tiers, objects evicted from memory
+// are demoted rather than lost so only count disk evictions
+func (t *TieredCache) Stats() CacheStats {
+    m := t.Mem.Stats()
+    d := t.Disk.Stats()
+    return CacheStats{
+        Entries:    m.Entries + d.Entries,
+        Bytes:      m.Bytes + d.Bytes,
+        Hits:       atomic.LoadInt64(&t.hits),
+        Misses:     atomic.LoadInt64(&t.misses),
+        Evictions:  d.Evictions,
+        Expired:    m.Expired + d.Expired,
+        Rejected:   m.Rejected + d.Rejected,
+    }
+}
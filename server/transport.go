@@ -0,0 +1,79 @@
+package server
+
+import (
+    "net"
+    "time"
+    "errors"
+    "context"
+    "net/http"
+)
+
+// origin connection defaults, times in seconds
+const (
+    defaultConnectTimeout       = 30
+    defaultTLSHandshakeTimeout  = 10
+    defaultIdleConnTimeout      = 90
+    defaultKeepAlive            = 30
+    defaultMaxIdleConns         = 100
+)
+
+// listener defaults, in seconds
+const (
+    defaultReadTimeout      = 60
+    defaultWriteTimeout     = 60
+)
+
+// seconds as a duration, def when not set
+func seconds(n, def int) time.Duration {
+    if n == 0 {
+        n = def
+    }
+    return time.Duration(n) * time.Second
+}
+
+// The transport a location's requests to its origins go through. A
+// response header timeout of 0 waits for as long as the origin takes
+// and a negative keepalive turns off TCP keep-alive probes.
+func (lc *LocationConfig) newTransport() *http.Transport {
+    dialer := &net.Dialer{
+        Timeout:    seconds(lc.ConnectTimeout, defaultConnectTimeout),
+        KeepAlive:  seconds(lc.KeepAlive, defaultKeepAlive),
+    }
+    maxIdle := lc.MaxIdleConns
+    if maxIdle == 0 {
+        maxIdle = defaultMaxIdleConns
+    }
+    return &http.Transport{
+        Proxy:                  http.ProxyFromEnvironment,
+        DialContext:            dialer.DialContext,
+        ForceAttemptHTTP2:      true,
+        TLSHandshakeTimeout:    seconds(lc.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+        ResponseHeaderTimeout:  seconds(lc.ResponseHeaderTimeout, 0),
+        IdleConnTimeout:        seconds(lc.IdleConnTimeout, defaultIdleConnTimeout),
+        ExpectContinueTimeout:  1 * time.Second,
+        MaxIdleConns:           maxIdle,
+        MaxIdleConnsPerHost:    lc.MaxIdleConnsPerHost,
+        MaxConnsPerHost:        lc.MaxConnsPerHost,
+        DisableKeepAlives:      lc.DisableKeepAlives,
+    }
+}
+
+// whether a request failed by running out of time
+func isTimeout(err error) bool {
+    if errors.Is(err, context.DeadlineExceeded) {
+        return true
+    }
+    var ne net.Error
+    return errors.As(err, &ne) && ne.Timeout()
+}
+
+// status for a request the origin gave no response to
+func originErrorStatus(err error) int {
+    if isTimeout(err) {
+        return http.StatusGatewayTimeout
+    }
+    if err == errNoOrigin {
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"errors"
+	"context"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// a net.Error that ran out of time
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ = Describe("Transport", func() {
+
+	It("tells timeouts apart from other errors, however they are wrapped", func() {
+		for _, c := range []struct {
+			err     error
+			want    bool
+		}{
+			{context.DeadlineExceeded, true},
+			{fmt.Errorf("backoff: %w", context.DeadlineExceeded), true},
+			{timeoutError{}, true},
+			{&url.Error{Op: "Get", URL: "http://origin/", Err: timeoutError{}}, true},
+			{context.Canceled, false},
+			{errors.New("connection refused"), false},
+		} {
+			Expect(isTimeout(c.err)).To(Equal(c.want), c.err.Error())
+		}
+	})
+
+	It("tries HTTP/2 with origins", func() {
+		lc := &LocationConfig{}
+		Expect(lc.newTransport().ForceAttemptHTTP2).To(BeTrue())
+	})
+
+	It("answers 504 to origin timeouts, 500 to other failures", func() {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		defer close(release)
+		lc := testLocation(slow.URL, func(lc *LocationConfig) {
+			lc.ResponseHeaderTimeout = 1
+		})
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusGatewayTimeout))
+
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		lc = testLocation(down.URL, nil)
+		Expect(serve(lc, "GET", "/a").Code).To(Equal(http.StatusInternalServerError))
+	})
+})
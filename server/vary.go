@@ -0,0 +1,114 @@
+package server
+
+import (
+    "sort"
+    "bytes"
+    "strings"
+    "net/http"
+)
+
+// Responses with a Vary header are stored once per combination of
+// the named request headers. The plain cache key then holds a marker
+// listing those headers, which is used to find the right variant.
+var varyMarkerPrefix = []byte("PONGO-VARY ")
+
+// canonical, sorted and deduplicated header names from a Vary header
+func varyHeaders(h http.Header) []string {
+    seen := make(map[string]bool)
+    names := make([]string, 0)
+    for _, v := range h["Vary"] {
+        for _, name := range strings.Split(v, ",") {
+            name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+            if name != "" && !seen[name] {
+                seen[name] = true
+                names = append(names, name)
+            }
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+func varyMarker(names []string) []byte {
+    return append(append([]byte{}, varyMarkerPrefix...), strings.Join(names, ",")...)
+}
+
+// header names stored in a vary marker, ok is false if data is a response
+func parseVaryMarker(data []byte) (names []string, ok bool) {
+    if !bytes.HasPrefix(data, varyMarkerPrefix) {
+        return nil, false
+    }
+    return strings.Split(string(data[len(varyMarkerPrefix):]), ","), true
+}
+
+// key of the variant matching the request's values for the vary headers
+func variantKey(key string, req *http.Request, names []string) string {
+    for _, name := range names {
+        key += "#" + name + "=" + strings.Join(req.Header[name], ",")
+    }
+    return key
+}
+
+// Look up a request's entry under key, or under the key of its variant
+// when key holds a vary marker. The marker is only peeked at, so each
+// request counts once in the cache stats.
+func lookupVariant(key string, req *http.Request) (cacheKey string, e *Entry, status string) {
+    cacheKey = key
+    if m, _ := cache.Peek(key); m != nil {
+        if vary, ok := parseVaryMarker(m.Response); ok {
+            cacheKey = variantKey(key, req, vary)
+        }
+    }
+    e, status = cache.Get(cacheKey)
+    if e != nil && cacheKey == key {
+        // a marker stored since it was peeked at
+        if vary, ok := parseVaryMarker(e.Response); ok {
+            cacheKey = variantKey(key, req, vary)
+            e, status = cache.Get(cacheKey)
+        }
+    }
+    return
+}
+
+// Rewrite the request headers listed in VaryNormalize to the first of
+// their configured values the client accepts, or remove them when it
+// accepts none. Done before the cache lookup and before proxying, so
+// the origin only ever sees, and varies on, the collapsed values.
+func (lc *LocationConfig) normalizeVary(req *http.Request) {
+    for name, values := range lc.VaryNormalize {
+        if _, ok := req.Header[name]; !ok {
+            continue
+        }
+        accepted := acceptedTokens(req.Header[name])
+        req.Header.Del(name)
+        for _, v := range values {
+            if accepted[strings.ToLower(v)] {
+                req.Header.Set(name, v)
+                break
+            }
+        }
+    }
+}
+
+// lower cased tokens from an Accept style header, skipping any
+// with a quality of zero
+func acceptedTokens(vv []string) map[string]bool {
+    tokens := make(map[string]bool)
+    for _, v := range vv {
+        for _, t := range strings.Split(v, ",") {
+            params := strings.Split(t, ";")
+            token := strings.ToLower(strings.TrimSpace(params[0]))
+            rejected := false
+            for _, p := range params[1:] {
+                p = strings.Replace(p, " ", "", -1)
+                if p == "q=0" || strings.HasPrefix(p, "q=0.") && strings.Trim(p[4:], "0") == "" {
+                    rejected = true
+                }
+            }
+            if token != "" && !rejected {
+                tokens[token] = true
+            }
+        }
+    }
+    return tokens
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vary", func() {
+
+	var (
+		origin  *httptest.Server
+		hits    int
+	)
+
+	BeforeEach(func() {
+		hits = 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			if r.URL.Path == "/any" {
+				w.Header().Set("Vary", "*")
+			} else {
+				w.Header().Set("Vary", "Accept-Language")
+			}
+			fmt.Fprintf(w, "%d %s", hits, r.Header.Get("Accept-Language"))
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("caches a variant for each value of the headers the origin varies on", func() {
+		lc := testLocation(origin.URL, nil)
+		for _, c := range []struct {
+			lang    string
+			body    string
+			status  string
+		}{
+			{"en", "1 en", "MISS"},
+			{"fr", "2 fr", "MISS"},
+			{"en", "1 en", "HIT"},
+			{"", "3 ", "MISS"},
+			{"fr", "2 fr", "HIT"},
+			{"", "3 ", "HIT"},
+		} {
+			r, status := serveStatus(lc, "GET", "/a", "Accept-Language", c.lang)
+			Expect(status).To(Equal(c.status), c.lang)
+			Expect(r.Body.String()).To(Equal(c.body), c.lang)
+		}
+		Expect(cache.Keys(func(string) bool { return true }, 0)).To(ConsistOf(
+			"GET example.com/a",
+			"GET example.com/a#Accept-Language=en",
+			"GET example.com/a#Accept-Language=fr",
+			"GET example.com/a#Accept-Language=",
+		))
+	})
+
+	It("normalizes the headers in vary_normalize before the lookup", func() {
+		lc := testLocation(origin.URL, func(lc *LocationConfig) {
+			lc.VaryNormalize = map[string][]string{"Accept-Language": {"fr", "en"}}
+		})
+		for _, c := range []struct {
+			lang    string
+			body    string
+		}{
+			{"de, en", "1 en"},
+			{"en-GB, en;q=0.5", "1 en"},
+			{"en, fr", "2 fr"},
+			{"fr;q=0, en", "1 en"},
+			{"de", "3 "},
+			{"", "3 "},
+		} {
+			Expect(serve(lc, "GET", "/a", "Accept-Language", c.lang).Body.String()).To(Equal(c.body), c.lang)
+		}
+	})
+
+	It("doesn't cache responses that vary on everything", func() {
+		lc := testLocation(origin.URL, nil)
+		serve(lc, "GET", "/any")
+		_, status := serveStatus(lc, "GET", "/any")
+		Expect(status).To(Equal("MISS"))
+		Expect(hits).To(Equal(2))
+	})
+})
@@ -0,0 +1,200 @@
+package server
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "bufio"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "encoding/xml"
+)
+
+// number of URLs warmed at once when -c isn't given
+const defaultWarmConcurrency = 8
+
+// number of failed URLs listed after the summary
+const maxWarmErrors = 10
+
+// the parts of a sitemap.xml that are used
+type sitemap struct {
+    URLs        []struct {
+        Loc     string  `xml:"loc"`
+    }                   `xml:"url"`
+}
+
+// outcome of warming a list of URLs
+type warmResult struct {
+    lock        sync.Mutex
+    Hits        int
+    Misses      int
+    Errors      []string
+}
+
+// Swallows the response to a warming request, only
+// keeping the status code
+type discardWriter struct {
+    header      http.Header
+    code        int
+}
+
+func (w *discardWriter) Header() http.Header {
+    return w.header
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+    if w.code == 0 {
+        w.code = code
+    }
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+    w.WriteHeader(http.StatusOK)
+    return len(b), nil
+}
+
+func registerWarmCommands() {
+    cmds["warm"] = &Command{
+        "warm",
+        "Warm the cache with the URLs in a file, one per line, or a sitemap.xml: warm [-c concurrency] <path>",
+        []string{},
+        map[string]*Command{},
+        func(context []string) (reply string, err error) {
+            concurrency := defaultWarmConcurrency
+            if len(context) > 1 && context[0] == "-c" {
+                if concurrency, err = strconv.Atoi(context[1]); err != nil || concurrency < 1 {
+                    return "", errors.New("Invalid concurrency " + context[1] + ".")
+                }
+                context = context[2:]
+            }
+            if len(context) == 0 {
+                return "", errors.New("Usage: " + cmds["warm"].Usage)
+            }
+            if cache == nil {
+                return "", errNoCache
+            }
+            urls, err := readWarmURLs(strings.Join(context, " "))
+            if err != nil {
+                return "", err
+            }
+            start := time.Now()
+            res := warmCache(urls, concurrency)
+            reply = fmt.Sprintf("Warmed %d URLs in %s: %d hits, %d misses, %d errors.",
+                len(urls), time.Since(start).Round(time.Millisecond), res.Hits, res.Misses, len(res.Errors))
+            for i, e := range res.Errors {
+                if i == maxWarmErrors {
+                    reply += "\r\n..."
+                    break
+                }
+                reply += "\r\n" + e
+            }
+            return reply, nil
+        },
+    }
+}
+
+// Read the URLs from a sitemap, or from a plain list with one
+// per line where blank lines and lines starting with # are skipped
+func readWarmURLs(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    b, err := ioutil.ReadAll(f)
+    if err != nil {
+        return nil, err
+    }
+
+    urls := make([]string, 0)
+    if bytes.HasPrefix(bytes.TrimSpace(b), []byte("<")) {
+        var sm sitemap
+        if err := xml.Unmarshal(b, &sm); err != nil {
+            return nil, errors.New("Unable to parse sitemap " + path + ": " + err.Error())
+        }
+        for _, u := range sm.URLs {
+            if loc := strings.TrimSpace(u.Loc); loc != "" {
+                urls = append(urls, loc)
+            }
+        }
+        return urls, nil
+    }
+
+    scanner := bufio.NewScanner(bytes.NewReader(b))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line != "" && !strings.HasPrefix(line, "#") {
+            urls = append(urls, line)
+        }
+    }
+    return urls, scanner.Err()
+}
+
+// Request every URL through its location's handler, as a client
+// would, with at most concurrency requests at once
+func warmCache(urls []string, concurrency int) *warmResult {
+    res := new(warmResult)
+    work := make(chan string)
+    var wg sync.WaitGroup
+    for i := 0; i < concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for u := range work {
+                status, err := warmURL(u)
+                res.add(u, status, err)
+            }
+        }()
+    }
+    for _, u := range urls {
+        work <- u
+    }
+    close(work)
+    wg.Wait()
+    return res
+}
+
+// request a single URL, returning its cache status
+func warmURL(rawurl string) (string, error) {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return "", err
+    }
+    lc := findLocation(u.Host, u.Path)
+    if lc == nil {
+        return "", errors.New("no location is configured for it")
+    }
+
+    req, err := http.NewRequest("GET", (&url.URL{Path: u.Path, RawQuery: u.RawQuery}).String(), nil)
+    if err != nil {
+        return "", err
+    }
+    req.Host = u.Host
+    req.RemoteAddr = "127.0.0.1:0"
+    rw := &discardWriter{header: make(http.Header)}
+    l := NewAccessLog()
+    proxyHandler{Config: lc}.serve(rw, req, l)
+    if rw.code >= 400 {
+        return l.CacheStatus, errors.New(strconv.Itoa(rw.code) + " " + http.StatusText(rw.code))
+    }
+    return l.CacheStatus, nil
+}
+
+func (res *warmResult) add(u, status string, err error) {
+    res.lock.Lock()
+    defer res.lock.Unlock()
+    switch {
+    case err != nil:
+        res.Errors = append(res.Errors, u + ": " + err.Error())
+    case strings.HasPrefix(status, "HIT") || status == "STALE" || status == "COLLAPSED":
+        res.Hits++
+    default:
+        res.Misses++
+    }
+}
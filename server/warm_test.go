@@ -0,0 +1,100 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"net/http/httptest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Warming", func() {
+
+	var (
+		origin  *httptest.Server
+		dir     string
+		paths   []string
+		mu      sync.Mutex
+		hosts   map[string]*vHost
+	)
+
+	BeforeEach(func() {
+		paths = nil
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths = append(paths, r.URL.RequestURI())
+			mu.Unlock()
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(r.URL.RequestURI()))
+		}))
+		lc := testLocation(origin.URL, nil)
+		hosts = vHosts
+		vHosts = map[string]*vHost{"example.com": {Location: map[string]*LocationConfig{"/": lc}}}
+
+		var err error
+		dir, err = ioutil.TempDir("", "warm")
+		Expect(err).NotTo(HaveOccurred())
+		if cmds == nil {
+			cmds = make(map[string]*Command)
+		}
+		registerWarmCommands()
+	})
+
+	AfterEach(func() {
+		vHosts = hosts
+		origin.Close()
+		os.RemoveAll(dir)
+	})
+
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	It("requests a list of URLs through their locations and fills the cache", func() {
+		path := file("urls", "# pages\nhttp://example.com/a\n\nhttp://example.com/b?x=1\nhttp://example.com/missing\nhttp://other.com/c\n")
+		reply, err := cmds["warm"].Action([]string{"-c", "2", path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply).To(MatchRegexp(`^Warmed 4 URLs in .*: 0 hits, 2 misses, 2 errors\.`))
+		Expect(reply).To(ContainSubstring("http://example.com/missing: 404 Not Found"))
+		Expect(reply).To(ContainSubstring("http://other.com/c: no location is configured for it"))
+		Expect(paths).To(ConsistOf("/a", "/b?x=1", "/missing"))
+
+		lc := vHosts["example.com"].Location["/"]
+		for _, p := range []string{"/a", "/b?x=1"} {
+			r, status := serveStatus(lc, "GET", p)
+			Expect(status).To(Equal("HIT"))
+			Expect(r.Body.String()).To(Equal(p))
+		}
+
+		reply, err = cmds["warm"].Action([]string{path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply).To(ContainSubstring(": 2 hits, 0 misses, 2 errors."))
+	})
+
+	It("reads the URLs of a sitemap", func() {
+		path := file("sitemap.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://example.com/a</loc></url>
+	<url><loc> http://example.com/b </loc></url>
+</urlset>`)
+		urls, err := readWarmURLs(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(urls).To(Equal([]string{"http://example.com/a", "http://example.com/b"}))
+	})
+
+	It("rejects bad arguments", func() {
+		_, err := cmds["warm"].Action([]string{"-c", "0", "urls"})
+		Expect(err).To(MatchError("Invalid concurrency 0."))
+		_, err = cmds["warm"].Action([]string{})
+		Expect(err).To(MatchError(HaveSuffix("warm [-c concurrency] <path>")))
+	})
+})